@@ -84,6 +84,8 @@ func (mode AddressMode) FetchPenalty() int {
 }
 
 // StorePenalty is the cycle penalty for doing page cross on a store operation.
+// Stores always take this cycle, whether a page is crossed or not, so it is
+// part of the base cycles of the indexed store opcodes.
 func (mode AddressMode) StorePenalty() int {
 	switch mode {
 	case AbsoluteX, AbsoluteY, IndirectIndexed:
@@ -93,6 +95,18 @@ func (mode AddressMode) StorePenalty() int {
 	}
 }
 
+// OperandSize is the number of operand bytes following the opcode.
+func (mode AddressMode) OperandSize() int {
+	switch mode {
+	case Implied, Accumulator:
+		return 0
+	case Absolute, AbsoluteX, AbsoluteY, Indirect:
+		return 2
+	default:
+		return 1
+	}
+}
+
 func (mode AddressMode) String() string {
 	if s, ok := addressModeName[mode]; ok {
 		return s
@@ -109,11 +123,24 @@ func FetchWord(mem memory.Memory, addr uint16) uint16 {
 	return lo | hi
 }
 
-// FetchWordBug is a helper to fetch a 16-bit word from memory
+// FetchWordBug is a helper to fetch a 16-bit word from memory, like the
+// indirect JMP it does not carry into the high byte of the address: the word at
+// $10FF is fetched from $10FF and $1000.
 func FetchWordBug(mem memory.Memory, addr uint16) uint16 {
 	var (
 		lo = uint16(mem.Fetch(addr))
-		hi = uint16(mem.Fetch(addr&0xff00)) | uint16(uint8(addr+1))<<8
+		hi = uint16(mem.Fetch(addr&0xff00|uint16(uint8(addr+1)))) << 8
+	)
+	return lo | hi
+}
+
+// FetchWordZP is a helper to fetch a 16-bit pointer from the zero page, like
+// the indexed indirect modes it wraps within the zero page: the word at $FF is
+// fetched from $FF and $00.
+func FetchWordZP(mem memory.Memory, zp uint8) uint16 {
+	var (
+		lo = uint16(mem.Fetch(uint16(zp)))
+		hi = uint16(mem.Fetch(uint16(zp+1))) << 8
 	)
 	return lo | hi
 }
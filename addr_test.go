@@ -0,0 +1,35 @@
+package mos65xx
+
+import "testing"
+
+func TestOperandSize(t *testing.T) {
+	for _, test := range []struct {
+		AddressMode
+		Size int
+	}{
+		{Implied, 0},
+		{Accumulator, 0},
+		{Immediate, 1},
+		{ZeroPage, 1},
+		{ZeroPageX, 1},
+		{ZeroPageY, 1},
+		{Relative, 1},
+		{Absolute, 2},
+		{AbsoluteX, 2},
+		{AbsoluteY, 2},
+		{Indirect, 2},
+		{IndexedIndirect, 1},
+		{IndirectIndexed, 1},
+	} {
+		if v := test.OperandSize(); v != test.Size {
+			t.Errorf("%s: expected %d, got %d", test.AddressMode, test.Size, v)
+		}
+	}
+
+	// Consistent with the opcode table
+	for code, op := range opcodes {
+		if int(op.Size) != 1+op.Mode.OperandSize() {
+			t.Errorf("opcode $%02X %s %s: size %d, expected %d", code, op.Mnemonic, op.Mode, op.Size, 1+op.Mode.OperandSize())
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package mos65xx
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AssembleLine encodes a single instruction, in the syntax used by
+// Instruction.Operand, for the instruction at pc:
+//
+//	LDA #$42
+//	STA $0200,X
+//	BNE $0600
+//
+// Numbers are hexadecimal if prefixed by "$", decimal otherwise. An address of
+// at most two hexadecimal digits (or a decimal value below 256) selects the
+// zero page mode, if the instruction has one. The operand of a branch is its
+// target address, which must be in range of pc. If an instruction has more
+// than one opcode for the same address mode, the documented one is used; if
+// none is documented (such as the NOP variants) the line is ambiguous and an
+// error is returned. Comments starting with ";" are ignored.
+func AssembleLine(s string, pc uint16) ([]byte, error) {
+	if i := strings.IndexByte(s, ';'); i >= 0 {
+		s = s[:i]
+	}
+	fields := strings.Fields(strings.ToUpper(s))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("mos65xx: %q: no instruction", s)
+	}
+
+	m, ok := mnemonicByName(fields[0])
+	if !ok {
+		return nil, fmt.Errorf("mos65xx: %q: unknown mnemonic %s", s, fields[0])
+	}
+
+	var (
+		operand = strings.Join(fields[1:], "")
+		value   int
+		modes   []AddressMode
+		err     error
+	)
+	switch {
+	case operand == "":
+		modes = []AddressMode{Implied, Accumulator}
+	case operand == "A":
+		modes = []AddressMode{Accumulator}
+	case strings.HasPrefix(operand, "#"):
+		modes = []AddressMode{Immediate}
+		value, _, err = parseNumber(operand[1:], 0xff)
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(operand, ",X)"):
+		modes = []AddressMode{IndexedIndirect}
+		value, _, err = parseNumber(operand[1:len(operand)-3], 0xff)
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(operand, "),Y"):
+		modes = []AddressMode{IndirectIndexed}
+		value, _, err = parseNumber(operand[1:len(operand)-3], 0xff)
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(operand, ")"):
+		modes = []AddressMode{Indirect}
+		value, _, err = parseNumber(operand[1:len(operand)-1], 0xffff)
+	default:
+		var zp, abs AddressMode
+		switch {
+		case strings.HasSuffix(operand, ",X"):
+			zp, abs, operand = ZeroPageX, AbsoluteX, operand[:len(operand)-2]
+		case strings.HasSuffix(operand, ",Y"):
+			zp, abs, operand = ZeroPageY, AbsoluteY, operand[:len(operand)-2]
+		default:
+			zp, abs = ZeroPage, Absolute
+		}
+		var short bool
+		if value, short, err = parseNumber(operand, 0xffff); short {
+			modes = []AddressMode{zp, abs}
+		} else {
+			modes = []AddressMode{abs}
+		}
+		if zp == ZeroPage {
+			// Branch targets are never indexed
+			modes = append(modes, Relative)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mos65xx: %q: %v", s, err)
+	}
+
+	for _, mode := range modes {
+		code, ok, ambiguous := opcodeFor(m, mode)
+		if !ok {
+			continue
+		} else if ambiguous {
+			return nil, fmt.Errorf("mos65xx: %q: ambiguous, %s has more than one undocumented opcode for this operand", s, m)
+		}
+		switch mode {
+		case Implied, Accumulator:
+			return []byte{code}, nil
+		case Relative:
+			offset := value - int(pc) - 2
+			if offset < -128 || offset > 127 {
+				return nil, fmt.Errorf("mos65xx: %q: branch target $%04X out of range of $%04X", s, value, pc)
+			}
+			return []byte{code, uint8(offset)}, nil
+		}
+		switch mode.OperandSize() {
+		case 1:
+			return []byte{code, uint8(value)}, nil
+		default:
+			return []byte{code, uint8(value), uint8(value >> 8)}, nil
+		}
+	}
+	return nil, fmt.Errorf("mos65xx: %q: %s does not support this operand", s, m)
+}
+
+// mnemonicByName looks up a mnemonic
+func mnemonicByName(name string) (Mnemonic, bool) {
+	for m, s := range mnemonicName {
+		if s == name {
+			return Mnemonic(m), true
+		}
+	}
+	return 0, false
+}
+
+// opcodeFor returns the opcode for the mnemonic in the address mode,
+// preferring documented opcodes; ambiguous is true if there is more than one
+// opcode and none of them is documented
+func opcodeFor(m Mnemonic, mode AddressMode) (code uint8, ok, ambiguous bool) {
+	for i, op := range opcodes {
+		if op.Mnemonic != m || op.Mode != mode {
+			continue
+		}
+		if documented(uint8(i)) {
+			return uint8(i), true, false
+		}
+		if ok {
+			ambiguous = true
+		} else {
+			code, ok = uint8(i), true
+		}
+	}
+	return
+}
+
+// parseNumber parses a hexadecimal ($) or decimal number up to max, short is
+// true if it was written as a zero page address
+func parseNumber(s string, max int) (value int, short bool, err error) {
+	var v uint64
+	if strings.HasPrefix(s, "$") {
+		s = s[1:]
+		v, err = strconv.ParseUint(s, 16, 16)
+		short = len(s) <= 2
+	} else {
+		v, err = strconv.ParseUint(s, 10, 16)
+		short = v <= 0xff
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid number %q", s)
+	}
+	if int(v) > max {
+		return 0, false, fmt.Errorf("value %d out of range", v)
+	}
+	return int(v), short, nil
+}
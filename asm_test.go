@@ -0,0 +1,87 @@
+package mos65xx
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+func TestAssembleLine(t *testing.T) {
+	for _, test := range []struct {
+		Line string
+		PC   uint16
+		Want []byte
+	}{
+		{"LDA #$42", 0x0600, []byte{0xa9, 0x42}},
+		{"lda #66", 0x0600, []byte{0xa9, 0x42}},
+		{"LDA $10", 0x0600, []byte{0xa5, 0x10}},
+		{"LDA $0010", 0x0600, []byte{0xad, 0x10, 0x00}},
+		{"LDA 4096,X", 0x0600, []byte{0xbd, 0x00, 0x10}},
+		{"JMP $10", 0x0600, []byte{0x4c, 0x10, 0x00}}, // No zero page mode
+		{"JMP ($FFFC)", 0x0600, []byte{0x6c, 0xfc, 0xff}},
+		{"STA ($10,X)", 0x0600, []byte{0x81, 0x10}},
+		{"STA ($10),Y", 0x0600, []byte{0x91, 0x10}},
+		{"LDX $10,Y", 0x0600, []byte{0xb6, 0x10}},
+		{"ROR", 0x0600, []byte{0x6a}},
+		{"ROR A", 0x0600, []byte{0x6a}},
+		{"SBC #$01", 0x0600, []byte{0xe9, 0x01}}, // Documented over $EB
+		{"NOP", 0x0600, []byte{0xea}},            // Documented over $1A
+		{"LAX $10 ; illegal", 0x0600, []byte{0xa7, 0x10}},
+		{"BNE $0600", 0x0600, []byte{0xd0, 0xfe}},
+		{"BEQ $0681", 0x0600, []byte{0xf0, 0x7f}},
+		{"BCC $0582", 0x0600, []byte{0x90, 0x80}},
+	} {
+		got, err := AssembleLine(test.Line, test.PC)
+		if err != nil {
+			t.Errorf("%q: %v", test.Line, err)
+		} else if !bytes.Equal(got, test.Want) {
+			t.Errorf("%q: expected % X, got % X", test.Line, test.Want, got)
+		}
+	}
+}
+
+func TestAssembleLineError(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"FOO",
+		"LDA #$100",     // Out of range
+		"LDA #",         // Missing value
+		"LDA ($1234),Y", // Unencodable
+		"STX $1234,Y",   // No absolute indexed Y mode
+		"JMP ($10,X)",   // No indexed indirect mode
+		"INX A",         // No accumulator mode
+		"BNE $0700",     // Out of range
+		"BNE $0581",     // Out of range
+		"BNE $10,X",     // Branches are not indexed
+		"NOP $44",       // Ambiguous: $04, $44 and $64
+		"NOP #$12",      // Ambiguous: $80, $82, $89, $C2 and $E2
+	} {
+		if b, err := AssembleLine(line, 0x0600); err == nil {
+			t.Errorf("%q: expected error, got % X", line, b)
+		}
+	}
+}
+
+func TestAssembleLineDisassemble(t *testing.T) {
+	// All documented instructions assemble back to their own encoding
+	for code := 0; code < 0x100; code++ {
+		if !documented(uint8(code)) || opcodes[code].Mnemonic == HLT {
+			continue
+		}
+		mem := memory.New(0x10000)
+		copy((*mem)[0x0600:], []byte{uint8(code), 0x12, 0x34})
+
+		var (
+			in   = Disassemble(mem, 0x0600)
+			line = fmt.Sprintf("%s %s", in.Mnemonic, in.Operand())
+		)
+		got, err := AssembleLine(line, 0x0600)
+		if err != nil {
+			t.Errorf("$%02X %q: %v", code, line, err)
+		} else if !bytes.Equal(got, in.Raw) {
+			t.Errorf("$%02X %q: expected % X, got % X", code, line, in.Raw, got)
+		}
+	}
+}
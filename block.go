@@ -0,0 +1,155 @@
+package mos65xx
+
+import (
+	"sort"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+// Block is a basic block: a run of instructions that is only entered at the
+// first and only left after the last instruction.
+type Block struct {
+	// Start and End are the addresses of the first and last instruction.
+	Start, End uint16
+
+	// Successors are the addresses control may pass to after the block. They
+	// are unknown (empty) for blocks ending in an indirect jump, a return,
+	// BRK, HLT or an instruction truncated at the end of memory.
+	Successors []uint16
+}
+
+// BasicBlocks decodes the code reachable from entry into basic blocks, sorted
+// by address. Branches, jumps and subroutine calls are followed; a block ends
+// at a branch, jump or call, before a branch target and after RTS, RTI, BRK
+// and HLT.
+func BasicBlocks(mem memory.Memory, entry uint16) []Block {
+	var (
+		code    = reachable(mem, entry)
+		leaders = map[uint16]bool{entry: true}
+	)
+	for addr, in := range code {
+		targets, falls := flow(in)
+		for _, target := range targets {
+			leaders[target] = true
+		}
+		if len(targets) > 0 && falls {
+			leaders[addr+uint16(in.Size)] = true
+		}
+	}
+
+	var starts []int
+	for addr := range leaders {
+		starts = append(starts, int(addr))
+	}
+	sort.Ints(starts)
+
+	blocks := make([]Block, 0, len(starts))
+	for _, start := range starts {
+		block := Block{Start: uint16(start)}
+		for addr := block.Start; ; {
+			in := code[addr]
+			block.End = addr
+			targets, falls := flow(in)
+			next := addr + uint16(in.Size)
+			if len(targets) > 0 || !falls {
+				block.Successors = targets
+				if falls {
+					block.Successors = append(block.Successors, next)
+				}
+				break
+			}
+			if leaders[next] {
+				block.Successors = []uint16{next}
+				break
+			}
+			addr = next
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// DisassembleReachable decodes the code reachable from the entry points, such
+// as the reset vector, by following branches, jumps and subroutine calls like
+// BasicBlocks. Indirect jumps, returns, BRK and HLT end the flow. The code is
+// keyed by address; data are the addresses between the first and the last
+// reachable instruction that are not part of any instruction, in ascending
+// order.
+func DisassembleReachable(mem memory.Memory, entries ...uint16) (code map[uint16]Instruction, data []uint16) {
+	code = reachable(mem, entries...)
+	if len(code) == 0 {
+		return
+	}
+
+	var (
+		covered    = make(map[uint16]bool)
+		start, end = 0xffff, 0
+	)
+	for addr, in := range code {
+		for i := range in.Raw {
+			covered[addr+uint16(i)] = true
+		}
+		if int(addr) < start {
+			start = int(addr)
+		}
+		if last := int(addr) + len(in.Raw) - 1; last > end {
+			end = last
+		}
+	}
+	for addr := start; addr <= end; addr++ {
+		if !covered[uint16(addr)] {
+			data = append(data, uint16(addr))
+		}
+	}
+	return
+}
+
+// reachable decodes the instructions reachable from the entry points
+func reachable(mem memory.Memory, entries ...uint16) map[uint16]Instruction {
+	var (
+		code  = make(map[uint16]Instruction)
+		queue = append([]uint16(nil), entries...)
+	)
+	for len(queue) > 0 {
+		addr := queue[0]
+		queue = queue[1:]
+		for {
+			if _, seen := code[addr]; seen {
+				break
+			}
+			in := Disassemble(mem, addr)
+			code[addr] = in
+
+			targets, falls := flow(in)
+			queue = append(queue, targets...)
+			if !falls {
+				break
+			}
+			addr += uint16(in.Size)
+		}
+	}
+	return code
+}
+
+// flow returns the jump targets of the instruction and if execution may
+// continue with the next instruction
+func flow(in Instruction) (targets []uint16, falls bool) {
+	if in.Truncated {
+		return nil, false
+	}
+	switch in.Mnemonic {
+	case BCC, BCS, BEQ, BMI, BNE, BPL, BVC, BVS:
+		return []uint16{in.Registers.PC + 2 + uint16(int8(in.Raw[1]))}, true
+	case JSR:
+		return []uint16{uint16(in.Raw[1]) | uint16(in.Raw[2])<<8}, true
+	case JMP:
+		if in.AddressMode == Absolute {
+			return []uint16{uint16(in.Raw[1]) | uint16(in.Raw[2])<<8}, false
+		}
+		return nil, false
+	case RTS, RTI, BRK, HLT:
+		return nil, false
+	default:
+		return nil, true
+	}
+}
@@ -0,0 +1,83 @@
+package mos65xx
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+func TestBasicBlocks(t *testing.T) {
+	mem := memory.New(0x10000)
+	copy((*mem)[0x0600:], []byte{
+		0xa2, 0x05, // LDX #$05
+		0xca,       // DEX
+		0xd0, 0xfd, // BNE $0602
+		0x20, 0x10, 0x06, // JSR $0610
+		0x6c, 0x00, 0x02, // JMP ($0200)
+	})
+	copy((*mem)[0x0610:], []byte{
+		0xe8,             // INX
+		0x4c, 0x20, 0x06, // JMP $0620
+	})
+	copy((*mem)[0x0620:], []byte{
+		0x60, // RTS
+	})
+
+	want := []Block{
+		{0x0600, 0x0600, []uint16{0x0602}},
+		{0x0602, 0x0603, []uint16{0x0602, 0x0605}},
+		{0x0605, 0x0605, []uint16{0x0610, 0x0608}},
+		{0x0608, 0x0608, nil},
+		{0x0610, 0x0611, []uint16{0x0620}},
+		{0x0620, 0x0620, nil},
+	}
+	if got := BasicBlocks(mem, 0x0600); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected blocks:\n%+v\ngot:\n%+v", want, got)
+	}
+}
+
+func TestDisassembleReachable(t *testing.T) {
+	mem := memory.New(0x10000)
+	copy((*mem)[0x0600:], []byte{
+		0x20, 0x08, 0x06, // JSR $0608
+		0x4c, 0x10, 0x06, // JMP $0610
+		0x41, 0x42, // Data "AB"
+		0xf0, 0x01, // BEQ $060B
+		0x60,             // RTS
+		0xea,             // NOP
+		0x60,             // RTS
+		0xff, 0xff, 0xff, // Data
+		0x6c, 0xfc, 0xff, // JMP ($FFFC)
+	})
+	copy((*mem)[0x0700:], []byte{
+		0x02, // KIL
+	})
+
+	code, data := DisassembleReachable(mem, 0x0600, 0x0700)
+	var addrs []int
+	for addr := range code {
+		addrs = append(addrs, int(addr))
+	}
+	sort.Ints(addrs)
+	if want := []int{0x0600, 0x0603, 0x0608, 0x060a, 0x060b, 0x060c, 0x0610, 0x0700}; !reflect.DeepEqual(addrs, want) {
+		t.Errorf("expected code at %x, got %x", want, addrs)
+	}
+	if v := code[0x0608].Mnemonic; v != BEQ {
+		t.Errorf("expected BEQ at $0608, got %s", v)
+	}
+
+	var want []uint16
+	want = append(want, 0x0606, 0x0607, 0x060d, 0x060e, 0x060f)
+	for addr := uint16(0x0613); addr < 0x0700; addr++ {
+		want = append(want, addr)
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Errorf("expected data at %x, got %x", want, data)
+	}
+
+	if code, data := DisassembleReachable(mem); len(code) != 0 || data != nil {
+		t.Errorf("expected nothing without entries, got %d instructions", len(code))
+	}
+}
@@ -0,0 +1,167 @@
+// Package c64 builds the memory map of the Commodore 64.
+package c64
+
+import (
+	"fmt"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+// ROM sizes
+const (
+	BASICSize  = 0x2000
+	KERNALSize = 0x2000
+	CharSize   = 0x1000
+)
+
+// Processor port bits that select the memory configuration
+const (
+	LORAM  uint8 = 1 << iota // BASIC ROM at $A000
+	HIRAM                    // KERNAL ROM at $E000
+	CHAREN                   // I/O instead of character ROM at $D000
+)
+
+// Memory is the C64 memory map: 64kB of RAM with the BASIC, KERNAL and
+// character ROM and the I/O area banked in by the processor port at $0000
+// (data direction) and $0001 (data). Writes to a ROM area go to the RAM
+// underneath. Cartridges (the GAME and EXROM lines) are not supported.
+//
+// Memory emulates the processor port itself, unless UsePort connects it to
+// the port of the CPU.
+type Memory struct {
+	*memory.Mapper
+
+	// RAM is the 64kB main memory.
+	RAM *memory.RAM
+
+	// BASIC, KERNAL and Char are the ROM images.
+	BASIC, KERNAL, Char memory.ROM
+
+	// IO is the I/O area at $D000-$DFFF, addressed with the full address.
+	IO memory.Memory
+
+	ddr, data uint8
+	cpu       Port
+	ports     *memory.IO
+	layouts   [8]*memory.Mapper // By LORAM, HIRAM and CHAREN
+}
+
+// Port is an on-chip processor port, such as a mos65xx.CPU with
+// Model.HasIOPort.
+type Port interface {
+	PortOutput() uint8
+}
+
+// New creates a new memory map with the processor port in its power-on
+// state, where the inputs are pulled up and all ROMs are visible. If io is
+// nil, the I/O area is open.
+func New(basic, kernal, char memory.ROM, io memory.Memory) (*Memory, error) {
+	switch {
+	case len(basic) != BASICSize:
+		return nil, fmt.Errorf("c64: BASIC ROM must be %d bytes, got %d", BASICSize, len(basic))
+	case len(kernal) != KERNALSize:
+		return nil, fmt.Errorf("c64: KERNAL ROM must be %d bytes, got %d", KERNALSize, len(kernal))
+	case len(char) != CharSize:
+		return nil, fmt.Errorf("c64: character ROM must be %d bytes, got %d", CharSize, len(char))
+	}
+	if io == nil {
+		io = memory.Blank(0xff)
+	}
+	m := &Memory{
+		RAM:    memory.New(0x10000),
+		BASIC:  basic,
+		KERNAL: kernal,
+		Char:   char,
+		IO:     io,
+	}
+	m.ports = m.port()
+	m.Bank()
+	return m, nil
+}
+
+// UsePort banks from the output of the CPU's processor port, instead of the
+// port emulated by Memory. Such a CPU answers reads of $0000 and $0001 itself
+// and passes the writes on, which update the banking. Changes to the port
+// that are not seen on the bus, by CPU.SetPortInput and by a reset of the
+// CPU, require a call to Bank. Pass nil to use the emulated port again.
+func (m *Memory) UsePort(port Port) {
+	m.cpu = port
+	m.Bank()
+}
+
+// Port returns the value of the processor port as seen by the banking logic.
+// For the emulated port, bits configured as input read as 1.
+func (m *Memory) Port() uint8 {
+	if m.cpu != nil {
+		return m.cpu.PortOutput()
+	}
+	return m.data&m.ddr | ^m.ddr
+}
+
+// port handles the processor port registers
+func (m *Memory) port() *memory.IO {
+	return &memory.IO{
+		Read: func(addr uint16) uint8 {
+			if addr == 0x0000 {
+				return m.ddr
+			}
+			return m.Port()
+		},
+		Write: func(addr uint16, value uint8) {
+			if addr == 0x0000 {
+				m.ddr = value
+			} else {
+				m.data = value
+			}
+			// The RAM underneath is written as well
+			m.RAM.Store(addr, value)
+			m.Bank()
+		},
+	}
+}
+
+// Bank maps the memory for the current port value. Each memory layout is
+// built once from the RAM, ROM and IO fields, switching banks only selects it.
+func (m *Memory) Bank() {
+	config := m.Port() & (LORAM | HIRAM | CHAREN)
+	if m.layouts[config] == nil {
+		m.layouts[config] = m.layout(config)
+	}
+	m.Mapper = m.layouts[config]
+}
+
+// layout builds the memory layout for the port configuration
+func (m *Memory) layout(config uint8) *memory.Mapper {
+	var (
+		loram  = config&LORAM != 0
+		hiram  = config&HIRAM != 0
+		charen = config&CHAREN != 0
+		mapper = memory.NewMapper()
+	)
+	mapper.Map(0x0000, 0xffff, m.RAM)
+	mapper.Map(0x0000, 0x0001, m.ports)
+	if loram && hiram {
+		mapper.Map(0xa000, 0xbfff, &rom{ROM: m.BASIC, ram: m.RAM, base: 0xa000})
+	}
+	if loram || hiram {
+		if charen {
+			mapper.Map(0xd000, 0xdfff, m.IO)
+		} else {
+			mapper.Map(0xd000, 0xdfff, &rom{ROM: m.Char, ram: m.RAM, base: 0xd000})
+		}
+	}
+	if hiram {
+		mapper.Map(0xe000, 0xffff, &rom{ROM: m.KERNAL, ram: m.RAM, base: 0xe000})
+	}
+	return mapper
+}
+
+// rom is ROM banked in over RAM, writes go to the RAM
+type rom struct {
+	memory.ROM
+	ram  *memory.RAM
+	base uint16
+}
+
+func (r *rom) Fetch(addr uint16) uint8        { return r.ROM.Fetch(addr - r.base) }
+func (r *rom) Store(addr uint16, value uint8) { r.ram.Store(addr, value) }
@@ -0,0 +1,141 @@
+package c64
+
+import (
+	"testing"
+
+	"github.com/tehmaze/mos65xx"
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+func testMemory(t *testing.T) *Memory {
+	t.Helper()
+	var (
+		basic  = make(memory.ROM, BASICSize)
+		kernal = make(memory.ROM, KERNALSize)
+		char   = make(memory.ROM, CharSize)
+		io     = &memory.IO{Read: func(uint16) uint8 { return 0x10 }}
+	)
+	for i := range basic {
+		basic[i] = 0xba
+	}
+	for i := range kernal {
+		kernal[i] = 0xe0
+	}
+	for i := range char {
+		char[i] = 0xc4
+	}
+	m, err := New(basic, kernal, char, io)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.RAM.Reset(0x00)
+	return m
+}
+
+func TestBanking(t *testing.T) {
+	m := testMemory(t)
+	m.Store(0x0000, 0x07) // Bits 0-2 are outputs
+
+	for _, test := range []struct {
+		Port             uint8
+		A000, D000, E000 uint8
+	}{
+		{0x07, 0xba, 0x10, 0xe0}, // Default: BASIC, I/O and KERNAL
+		{0x06, 0x00, 0x10, 0xe0}, // No BASIC
+		{0x05, 0x00, 0x10, 0x00}, // I/O only
+		{0x03, 0xba, 0xc4, 0xe0}, // Character ROM
+		{0x02, 0x00, 0xc4, 0xe0}, // Character ROM and KERNAL
+		{0x04, 0x00, 0x00, 0x00}, // All RAM
+		{0x00, 0x00, 0x00, 0x00}, // All RAM
+	} {
+		m.Store(0x0001, test.Port)
+		for addr, want := range map[uint16]uint8{0xa000: test.A000, 0xd000: test.D000, 0xe000: test.E000} {
+			if v := m.Fetch(addr); v != want {
+				t.Errorf("port $%02X: expected $%02X at $%04X, got $%02X", test.Port, want, addr, v)
+			}
+		}
+	}
+
+	// The layouts are built once, switching banks does not allocate
+	if n := testing.AllocsPerRun(100, func() {
+		m.Store(0x0001, 0x07)
+		m.Store(0x0001, 0x03)
+	}); n != 0 {
+		t.Errorf("expected no allocations switching banks, got %.1f", n)
+	}
+	if v := m.Fetch(0xd000); v != 0xc4 {
+		t.Errorf("expected character ROM at $D000, got $%02X", v)
+	}
+}
+
+func TestPort(t *testing.T) {
+	m := testMemory(t)
+
+	// Inputs are pulled up at power on, all ROMs are visible
+	if v := m.Fetch(0x0001); v != 0xff {
+		t.Errorf("expected port $FF, got $%02X", v)
+	}
+	m.Store(0x0001, 0x00)
+	if v := m.Fetch(0xa000); v != 0xba {
+		t.Errorf("expected BASIC with the port as input, got $%02X", v)
+	}
+
+	m.Store(0x0000, 0x2f)
+	if v := m.Fetch(0x0000); v != 0x2f {
+		t.Errorf("expected data direction $2F, got $%02X", v)
+	}
+	if v := m.Fetch(0x0001); v != 0xd0 {
+		t.Errorf("expected port $D0, got $%02X", v)
+	}
+}
+
+func TestWriteUnderROM(t *testing.T) {
+	m := testMemory(t)
+	m.Store(0xa000, 0x42)
+	m.Store(0xe000, 0x43)
+	if v := m.Fetch(0xa000); v != 0xba {
+		t.Errorf("expected BASIC ROM at $A000, got $%02X", v)
+	}
+
+	m.Store(0x0000, 0x07)
+	m.Store(0x0001, 0x00)
+	if v := m.Fetch(0xa000); v != 0x42 {
+		t.Errorf("expected RAM written under BASIC, got $%02X", v)
+	}
+	if v := m.Fetch(0xe000); v != 0x43 {
+		t.Errorf("expected RAM written under KERNAL, got $%02X", v)
+	}
+}
+
+func TestCPU(t *testing.T) {
+	m := testMemory(t)
+	copy((*m.RAM)[0x0800:], []byte{
+		0xa9, 0x07, // LDA #$07
+		0x85, 0x00, // STA $00
+		0xa9, 0x35, // LDA #$35
+		0x85, 0x01, // STA $01
+		0xad, 0x00, 0xe0, // LDA $E000
+	})
+
+	cpu := mos65xx.New(mos65xx.MOS6510, m)
+	m.UsePort(cpu)
+	cpu.Registers().PC = 0x0800
+	for i := 0; i < 5; i++ {
+		cpu.Step()
+	}
+	if v := cpu.Registers().A; v != 0x00 {
+		t.Errorf("expected RAM under KERNAL, got $%02X", v)
+	}
+
+	// Banking follows the inputs of the CPU port
+	cpu.Reset()
+	m.Bank()
+	if v := m.Fetch(0xe000); v != 0xe0 {
+		t.Errorf("expected KERNAL with the port as input, got $%02X", v)
+	}
+	cpu.SetPortInput(^HIRAM)
+	m.Bank()
+	if v := m.Fetch(0xe000); v != 0x00 {
+		t.Errorf("expected RAM under KERNAL with HIRAM low, got $%02X", v)
+	}
+}
@@ -0,0 +1,71 @@
+package mos65xx
+
+// decodeCacheSize is the number of cached instructions, a power of two
+const decodeCacheSize = 4096
+
+// decoded is a cached instruction
+type decoded struct {
+	pc     uint16
+	valid  bool
+	code   uint8
+	static bool   // addr does not depend on the registers or memory
+	addr   uint16 // Resolved address, if static
+}
+
+// decodeCache is a direct mapped cache of decoded instructions, keyed by PC,
+// for regions that are declared not to be modified by the code
+type decodeCache struct {
+	regions [][2]uint16
+	entries [decodeCacheSize]decoded
+}
+
+// covers checks if addr is in one of the regions
+func (c *decodeCache) covers(addr uint16) bool {
+	for _, r := range c.regions {
+		if addr >= r[0] && addr <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup returns the cached instruction at pc, or nil
+func (c *decodeCache) lookup(pc uint16) *decoded {
+	e := &c.entries[pc&(decodeCacheSize-1)]
+	if e.valid && e.pc == pc {
+		return e
+	}
+	return nil
+}
+
+// fill caches the instruction at pc, if it is entirely in a region
+func (c *decodeCache) fill(pc uint16, code uint8, addr uint16) {
+	op := opcodes[code]
+	if !c.covers(pc) || !c.covers(pc+uint16(op.Size)-1) {
+		return
+	}
+
+	e := &c.entries[pc&(decodeCacheSize-1)]
+	*e = decoded{pc: pc, valid: true, code: code}
+	switch op.Mode {
+	case Implied, Accumulator, Immediate, ZeroPage, Absolute, Relative:
+		e.static, e.addr = true, addr
+	}
+}
+
+// invalidate the instructions that may contain addr
+func (c *decodeCache) invalidate(addr uint16) {
+	if !c.covers(addr) {
+		return
+	}
+	for pc := addr - 2; pc != addr+1; pc++ {
+		if e := &c.entries[pc&(decodeCacheSize-1)]; e.pc == pc {
+			e.valid = false
+		}
+	}
+}
+
+// flush all cached instructions
+func (c *decodeCache) flush() {
+	c.entries = [decodeCacheSize]decoded{}
+}
@@ -0,0 +1,21 @@
+package mos65xx
+
+import "time"
+
+// Clock is the source of time for real-time pacing, it can be replaced with
+// WithClock to test pacing deterministically.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// Sleep pauses for the duration
+	Sleep(time.Duration)
+}
+
+// RealClock is the Clock backed by the time package, it is the default.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
@@ -0,0 +1,44 @@
+package mos65xx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+// fakeClock advances only when slept on
+type fakeClock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.slept = append(c.slept, d)
+	c.now = c.now.Add(d)
+}
+
+func TestWithClock(t *testing.T) {
+	cpu := New(MOS6502, memory.New(0x10000))
+	if cpu.Clock() != RealClock {
+		t.Fatal("expected RealClock by default")
+	}
+
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	cpu.WithClock(clock)
+	cpu.Reset()
+	if cpu.Clock() != Clock(clock) {
+		t.Fatal("expected the injected clock to survive Reset")
+	}
+	cpu.Clock().Sleep(time.Millisecond)
+	if v := clock.Now(); !v.Equal(time.Unix(0, 0).Add(time.Millisecond)) {
+		t.Errorf("expected the fake clock to advance, got %s", v)
+	}
+
+	cpu.WithClock(nil)
+	if cpu.Clock() != RealClock {
+		t.Error("expected nil to restore RealClock")
+	}
+}
@@ -0,0 +1,128 @@
+package mos65xx
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+// compiled is a predecoded instruction
+type compiled struct {
+	op     func(uint16)
+	mode   AddressMode
+	pc     uint16
+	addr   uint16
+	static bool // addr is known at compile time
+}
+
+// Compile predecodes the straight-line code from start up to and including
+// end into a function that replays its effect on the registers and mem in one
+// call, without fetching and decoding the instructions again. The code is
+// executed with the semantics of the MOS6502 model; cycles are not counted
+// and interrupts are not handled. After the call, PC points past end.
+//
+// Compile fails if the region contains control flow (branches, jumps,
+// subroutine calls and returns, BRK or HLT), if the last instruction extends
+// past end, or if an instruction may store into the region itself. Stores to
+// an address that is not known at compile time (the indirect modes) are
+// rejected, as are stack pushes when the region overlaps the stack page.
+func Compile(mem memory.Memory, start, end uint16) (func(*Registers), error) {
+	var (
+		cpu  = New(MOS6502, mem).(*fast)
+		code []compiled
+	)
+	for addr := int(start); addr <= int(end); {
+		in := Disassemble(mem, uint16(addr))
+		if err := compilable(in, start, end); err != nil {
+			return nil, fmt.Errorf("mos65xx: compile $%04X: %s: %v", addr, in.listing(), err)
+		}
+
+		c := compiled{
+			op:   cpu.ops[in.Mnemonic],
+			mode: in.AddressMode,
+			pc:   uint16(addr),
+		}
+		switch in.AddressMode {
+		case Implied, Accumulator:
+			c.static = true
+		case Immediate:
+			c.addr, c.static = uint16(addr+1), true
+		case ZeroPage:
+			c.addr, c.static = uint16(in.Raw[1]), true
+		case Absolute:
+			c.addr, c.static = uint16(in.Raw[1])|uint16(in.Raw[2])<<8, true
+		}
+		code = append(code, c)
+		addr += in.Size
+	}
+
+	next := end + 1
+	return func(r *Registers) {
+		cpu.reg = r
+		for _, c := range code {
+			addr := c.addr
+			cpu.addressMode = c.mode
+			if !c.static {
+				cpu.reg.PC = c.pc
+				_, addr = cpu.resolveAddr()
+			}
+			c.op(addr)
+		}
+		r.PC = next
+	}, nil
+}
+
+// compilable checks if the instruction can be compiled in the region
+func compilable(in Instruction, start, end uint16) error {
+	if int(in.Registers.PC)+in.Size-1 > int(end) {
+		return fmt.Errorf("instruction extends past $%04X", end)
+	}
+
+	switch in.Mnemonic {
+	case JMP, JSR, RTS, RTI, BRK, HLT:
+		return errors.New("control flow")
+	case PHA, PHP:
+		if overlaps(DefaultStackBase, DefaultStackBase+0xff, int(start), int(end)) {
+			return errors.New("push into the region")
+		}
+	}
+	if in.AddressMode == Relative {
+		return errors.New("branch")
+	}
+	if !writesMemory(in.Mnemonic) || in.AddressMode == Accumulator {
+		return nil
+	}
+
+	var (
+		base = uint16(in.Raw[1])
+		lo   = int(base)
+		hi   int
+	)
+	if in.Size > 2 {
+		base |= uint16(in.Raw[2]) << 8
+		lo = int(base)
+	}
+	switch in.AddressMode {
+	case ZeroPage, Absolute:
+		hi = lo
+	case ZeroPageX, ZeroPageY:
+		lo, hi = 0x00, 0xff
+	case AbsoluteX, AbsoluteY:
+		hi = lo + 0xff
+	default:
+		return errors.New("store to an unknown address")
+	}
+	if hi > 0xffff {
+		// Indexing wraps around the address space
+		lo, hi = 0x0000, 0xffff
+	}
+	if overlaps(lo, hi, int(start), int(end)) {
+		return errors.New("store into the region")
+	}
+	return nil
+}
+
+func overlaps(a, b, c, d int) bool {
+	return a <= d && c <= b
+}
@@ -0,0 +1,82 @@
+package mos65xx
+
+import (
+	"testing"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+func TestCompile(t *testing.T) {
+	code := []byte{
+		0xa9, 0x42, // LDA #$42
+		0x18,       // CLC
+		0x69, 0x01, // ADC #$01
+		0x85, 0x10, // STA $10
+		0x9d, 0x00, 0x02, // STA $0200,X
+		0xb1, 0x20, // LDA ($20),Y
+		0xe6, 0x10, // INC $10
+		0x48, // PHA
+		0xaa, // TAX
+	}
+	load := func() *memory.RAM {
+		mem := memory.New(0x10000).Reset(0xea) // NOP
+		copy((*mem)[0x0600:], code)
+		StoreWord(mem, 0x0020, 0x1234)
+		mem.Store(0x1236, 0x99)
+		return mem
+	}
+	regs := Registers{X: 0x03, Y: 0x02, S: 0xfd, P: U}
+
+	// Compiled
+	mem := load()
+	fn, err := Compile(mem, 0x0600, 0x0600+uint16(len(code))-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := regs
+	fn(&got)
+
+	// Stepped
+	want := regs
+	want.PC = 0x0600
+	ref := load()
+	cpu := New(MOS6502, ref)
+	*cpu.Registers() = want
+	for cpu.Registers().PC < 0x0600+uint16(len(code)) {
+		cpu.Step()
+	}
+	want = *cpu.Registers()
+
+	if got != want {
+		t.Fatalf("expected registers %+v, got %+v", want, got)
+	}
+	for _, addr := range []uint16{0x0010, 0x0203, 0x01fd} {
+		if v, w := mem.Fetch(addr), ref.Fetch(addr); v != w {
+			t.Errorf("expected $%02X at $%04X, got $%02X", w, addr, v)
+		}
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	for _, test := range []struct {
+		Code  []byte
+		Start uint16
+	}{
+		{[]byte{0xd0, 0xfe}, 0x0600},       // BNE *
+		{[]byte{0x4c, 0x00, 0x06}, 0x0600}, // JMP $0600
+		{[]byte{0x6c, 0x00, 0x02}, 0x0600}, // JMP ($0200)
+		{[]byte{0x60}, 0x0600},             // RTS
+		{[]byte{0x8d, 0x01, 0x06}, 0x0600}, // STA $0601
+		{[]byte{0x9d, 0xff, 0x05}, 0x0600}, // STA $05FF,X
+		{[]byte{0x91, 0x10}, 0x0600},       // STA ($10),Y
+		{[]byte{0x95, 0x10}, 0x0000},       // STA $10,X
+		{[]byte{0x48}, 0x0180},             // PHA
+		{[]byte{0xa9}, 0x0600},             // LDA # past the end
+	} {
+		mem := memory.New(0x10000).Reset(0xea) // NOP
+		copy((*mem)[test.Start:], test.Code)
+		if _, err := Compile(mem, test.Start, test.Start+uint16(len(test.Code))-1); err == nil {
+			t.Errorf("% X at $%04X: expected error", test.Code, test.Start)
+		}
+	}
+}
@@ -102,7 +102,7 @@ func (t condY) Cond(in Instruction) bool  { return in.CPU.Registers().Y == uint8
 func (t condY) String() string            { return fmt.Sprintf("Y      %s $%02X", condEqual, uint8(t)) }
 
 // condCycles are conditional cycle boundaries
-type condCycles [2]int
+type condCycles [2]int64
 
 func (t condCycles) Cond(in Instruction) bool {
 	if t[0] == t[1] || t[1] < t[0] {
@@ -146,16 +146,7 @@ func (t condByte) String() string {
 type condTrap struct{}
 
 func (t condTrap) Cond(in Instruction) bool {
-	switch in.Mnemonic {
-	case JMP, JSR:
-		addr := in.Addr()
-		if in.AddressMode == Indirect {
-			addr = FetchWord(in.CPU, addr)
-		}
-		return in.Registers.PC == addr
-	default:
-		return false
-	}
+	return in.trapped()
 }
 
 func (t condTrap) String() string {
@@ -8,22 +8,94 @@ import (
 )
 
 // CPU represents a MOS Technology 65xx Central Processing Unit
+//
+// To step backwards, record a History with RecordHistory and use its StepBack
+// method; it takes the place of a recording Monitor.
 type CPU interface {
 	// Memory as observed by the CPU
 	memory.Memory
 
-	// Registers returns a pointer to the CPU registers
+	// Registers returns a pointer to the live CPU registers, they change as
+	// the CPU executes; use Clone for a snapshot.
 	Registers() *Registers
 
+	// StackBase returns the base address of the stack page, the stack
+	// pointer is an offset into this page.
+	StackBase() uint16
+
+	// ZeroPage returns a snapshot copy of the zero page, read with Fetch.
+	ZeroPage() [256]byte
+
+	// Stack returns a snapshot copy of the stack page, read with Fetch.
+	Stack() [256]byte
+
+	// PeekStack returns the byte at depth above the stack pointer without
+	// pulling it, the address wraps within the stack page. The most recently
+	// pushed byte is at depth 1.
+	PeekStack(depth uint8) uint8
+
+	// PokeStack stores value at depth above the stack pointer without
+	// changing it, the address wraps within the stack page.
+	PokeStack(depth, value uint8)
+
 	// IRQ requests an interrupt
 	IRQ()
 
 	// NMI requests an non-maskable interrupt
 	NMI()
 
-	// Reset requests a cold reset
+	// IRQAfter and NMIAfter request an interrupt after n more instructions
+	// have executed, right before the next opcode fetch; n = 0 requests it
+	// before the next instruction. This is a convenience for reproducible
+	// interrupt tests that counts executed instructions (see Instructions)
+	// instead of modelling a timer. A new call replaces the previous
+	// request, Reset clears it.
+	IRQAfter(n int)
+	NMIAfter(n int)
+
+	// InterruptPending returns the requested interrupt that has not been
+	// handled yet, None if there is none.
+	InterruptPending() Interrupt
+
+	// InterruptsMasked returns true if IRQs are disabled by the I flag.
+	InterruptsMasked() bool
+
+	// SetPortInput sets the level of the on-chip I/O port pins configured as
+	// input, they are pulled up ($FF) after reset. It has no effect if the
+	// model has no I/O port, see Model.HasIOPort.
+	SetPortInput(uint8)
+
+	// PortOutput returns the level of the on-chip I/O port pins: the data
+	// register for pins configured as output, the input level for the others.
+	// It returns 0 if the model has no I/O port.
+	PortOutput() uint8
+
+	// SupportsBCD returns true if ADC and SBC honor decimal mode. Without
+	// BCD support (such as the Ricoh2A03) SED and CLD still set and clear
+	// the D flag, but it has no effect on the arithmetic.
+	SupportsBCD() bool
+
+	// Reset requests a cold reset, like the hardware it loads PC from the
+	// ResetVector. Afterwards S is $FD (see Model.DummyReads) and P is $34
+	// (I, B and U set), A, X and Y keep their values, pending interrupts and
+	// the halt state are cleared and the cycle and instruction counters are
+	// zero.
 	Reset()
 
+	// PowerOn is Reset with the power-on state: A, X and Y are zero and S
+	// starts at $00, the reset sequence then performs three stack reads
+	// that decrement it to $FD, as on the hardware.
+	PowerOn()
+
+	// ResetKeepPC is a soft reset that reinitializes the registers, clears
+	// pending interrupts and the halt state like Reset, but keeps the current
+	// PC. This is useful for running code from a known address.
+	ResetKeepPC()
+
+	// SetReset drives the reset line: while asserted Step does nothing,
+	// releasing it performs a Reset.
+	SetReset(asserted bool)
+
 	// Ready
 	Ready(bool)
 
@@ -31,20 +103,160 @@ type CPU interface {
 	// number of cycles spent on performing the operation.
 	Step() int
 
+	// StepInstruction is Step that also returns the instruction, as it was
+	// before execution, without attaching a Monitor. If no instruction was
+	// executed (the CPU is halted or not ready), the Instruction is the zero
+	// value.
+	StepInstruction() (Instruction, int)
+
+	// StepOut steps until the current subroutine or interrupt handler
+	// returns: until an RTS or RTI pulls the stack above the level it was at
+	// when called. A limit > 0 stops after that many cycles, for programs that
+	// manipulate the stack directly. It returns the number of cycles spent.
+	StepOut(limit int) int
+
 	// Run until the CPU receives a HLT instruction, returning the total
-	// number of cycles spent.
-	Run() int
+	// number of cycles spent. It also returns if Step makes no progress,
+	// while the CPU is not ready or held in reset.
+	Run() int64
+
+	// RunUntilHalt is Run for untrusted programs: it also stops once at
+	// least maxCycles have been spent (if > 0), when the CPU is not ready
+	// and when the program is stuck jumping or branching to itself, unless
+	// an event or IRQAfter/NMIAfter may still interrupt the loop. It returns
+	// the number of cycles spent and whether the CPU halted.
+	RunUntilHalt(maxCycles int) (int, bool)
+
+	// NextInstruction decodes the instruction at PC without executing it,
+	// the CPU state and cycle counter are not changed.
+	NextInstruction() Instruction
+
+	// Trace steps up to n instructions, or until halted, returning the
+	// instructions as they were before execution. It allocates for every
+	// instruction, for long runs attach a Monitor instead. It returns nil
+	// for n <= 0.
+	Trace(n int) []Instruction
+
+	// LastPageCrossed returns true if the page cross penalty cycle was
+	// applied by the most recent Step, including for taken branches. It is
+	// reset by every Step.
+	LastPageCrossed() bool
 
 	// Halted returns true if the CPU received a HLT instruction
 	Halted() bool
 
+	// HaltReason returns why the CPU halted, NotHalted if it is running.
+	HaltReason() HaltReason
+
+	// HaltedAt returns the address and opcode of the instruction that
+	// halted the CPU.
+	HaltedAt() (pc uint16, opcode uint8)
+
+	// OnHalt sets a function that gets called from Step when the CPU halts,
+	// with the reason and the address of the halting instruction. Pass nil
+	// to remove it.
+	OnHalt(fn func(reason HaltReason, pc uint16))
+
+	// OnTrap sets a function that gets called from Step, before execution,
+	// when the next instruction jumps or branches to itself. Such a tight
+	// loop is how test programs signal completion or failure and otherwise
+	// indicates a hang. Pass nil to remove it; detection has no cost unless
+	// a function is set.
+	OnTrap(fn func(pc uint16))
+
+	// Cycles returns the total number of cycles elapsed since the last
+	// reset.
+	Cycles() int64
+
+	// Instructions returns the number of instructions executed since the
+	// last reset. Interrupt sequences are not counted, nor are instructions
+	// stopped before execution by a Monitor or Model.StrictLegal.
+	Instructions() int64
+
+	// ResetCycles zeroes the cycle and instruction counters without
+	// resetting the CPU.
+	ResetCycles()
+
+	// SetInternalRAM replaces the internal RAM of the model with size bytes,
+	// zero removes it. The contents that fit are kept, new bytes are $FF.
+	// It returns an error unless the CPU is stopped (halted, not ready or
+	// held in reset) or if size is not a power of two of at most 64kB.
+	SetInternalRAM(size int) error
+
+	// CacheDecoding declares the memory from start up to and including end
+	// as not self-modifying (such as ROM), so Step may cache the decoded
+	// instructions in it. A cached instruction is not fetched from the bus
+	// again, and its address is not resolved again if it does not depend on
+	// the registers, so these reads are missing from Accesses. Stores by the
+	// CPU into the region invalidate the affected instructions, stores that
+	// bypass the CPU are not seen. Calling CacheDecoding again adds a region
+	// (if it is new) and flushes the cache. The cache is disabled by default.
+	//
+	// Bank switching changes the memory under a region without a store into
+	// it, so cached instructions from the old bank would still be executed.
+	// After a bank switch, such as a memory.Mapper remap, call CacheDecoding
+	// again to flush the cache. Stores to the I/O port (see Model.HasIOPort)
+	// flush the cache, as they select the banks on a 6510.
+	CacheDecoding(start, end uint16)
+
+	// WithClock replaces the Clock used for real-time pacing, nil restores
+	// RealClock. Reset does not change it.
+	WithClock(Clock)
+
+	// Clock returns the Clock used for real-time pacing.
+	Clock() Clock
+
+	// SetPPUPosition sets a function providing the PPU scanline and dot, for
+	// the PPU column of FormatNintendulator when emulating a NES. Pass nil to
+	// remove it.
+	SetPPUPosition(fn func() (scanline, dot int))
+
+	// PPUPosition returns the PPU scanline and dot, ok is false if there is
+	// no function set with SetPPUPosition.
+	PPUPosition() (scanline, dot int, ok bool)
+
 	// Attach a monitor
 	Attach(Monitor)
+
+	// ScheduleAfter schedules fn to run once the cycle counter has advanced
+	// by the number of cycles; the callback runs from Step, after the
+	// instruction that reached the target cycle, and may request interrupts.
+	// Delays below one cycle are rounded up, a callback that schedules itself
+	// again without delay runs after the next instruction.
+	ScheduleAfter(cycles int, fn func()) *Event
+
+	// CancelScheduled removes a scheduled event, returns false if the event
+	// already fired or was cancelled before.
+	CancelScheduled(*Event) bool
+
+	// Accesses returns the bus accesses performed by the last Step, in
+	// order. The slice is reused by the next Step. Dummy accesses are only
+	// included if enabled by the Model.
+	Accesses() []BusAccess
+
+	// BusReads and BusWrites return the number of bus accesses performed
+	// while executing since the last reset, they are zeroed with the cycle
+	// counter. The fast core counts the logical reads and writes of the
+	// instructions, the same accesses as reported by Accesses: internal
+	// cycles are not counted, nor are dummy accesses unless enabled by the
+	// Model, nor are fetches skipped by CacheDecoding. Accesses by a Monitor
+	// or through the CPU's Memory methods outside of Step are not counted.
+	BusReads() int64
+	BusWrites() int64
+
+	// AddressBusValue and DataBusValue return the address and data of the
+	// last bus access performed while executing, for a bus viewer. The fast
+	// core does not emulate individual cycles, so this is the last access
+	// made by an instruction rather than the value on the last cycle;
+	// internal cycles without a bus access are not reflected.
+	AddressBusValue() uint16
+	DataBusValue() uint8
 }
 
 /*
 // TODO: Not implemented
-// Accurate is a CPU implementation optimized for cycle accuracy
+// Accurate is a CPU implementation optimized for cycle accuracy, Step
+// ticks until the next opcode fetch, so it can be used wherever a CPU is.
 type Accurate interface {
 	CPU
 
@@ -63,6 +275,9 @@ type Registers struct {
 	Y  uint8  // Y index register
 }
 
+// Clone returns a copy of the registers that does not change with them
+func (reg *Registers) Clone() Registers { return *reg }
+
 // setFlag sets a process status register flag
 func setFlag(mask, flag uint8, set bool) uint8 {
 	if set {
@@ -71,17 +286,53 @@ func setFlag(mask, flag uint8, set bool) uint8 {
 	return mask & ^flag
 }
 
+// Carry returns true if the C flag is set
+func (reg *Registers) Carry() bool { return reg.P&C == C }
+
+// Zero returns true if the Z flag is set
+func (reg *Registers) Zero() bool { return reg.P&Z == Z }
+
+// IRQDisabled returns true if the I flag is set
+func (reg *Registers) IRQDisabled() bool { return reg.P&I == I }
+
+// Decimal returns true if the D flag is set
+func (reg *Registers) Decimal() bool { return reg.P&D == D }
+
+// Overflow returns true if the V flag is set
+func (reg *Registers) Overflow() bool { return reg.P&V == V }
+
+// Negative returns true if the N flag is set
+func (reg *Registers) Negative() bool { return reg.P&N == N }
+
+// SetCarry sets or clears the C flag
+func (reg *Registers) SetCarry(set bool) { reg.P = setFlag(reg.P, C, set) }
+
+// SetZero sets or clears the Z flag
+func (reg *Registers) SetZero(set bool) { reg.P = setFlag(reg.P, Z, set) }
+
+// SetIRQDisabled sets or clears the I flag
+func (reg *Registers) SetIRQDisabled(set bool) { reg.P = setFlag(reg.P, I, set) }
+
+// SetDecimal sets or clears the D flag
+func (reg *Registers) SetDecimal(set bool) { reg.P = setFlag(reg.P, D, set) }
+
+// SetOverflow sets or clears the V flag
+func (reg *Registers) SetOverflow(set bool) { reg.P = setFlag(reg.P, V, set) }
+
+// SetNegative sets or clears the N flag
+func (reg *Registers) SetNegative(set bool) { reg.P = setFlag(reg.P, N, set) }
+
 // setZN sets the Z and N flags based on the value
 func (reg *Registers) setZN(value uint8) {
-	reg.P = setFlag(reg.P, Z, value == 0x00)
-	reg.P = setFlag(reg.P, N, value&0x80 != 0x00)
+	reg.SetZero(value == 0x00)
+	reg.SetNegative(value&0x80 != 0x00)
 }
 
 // cmp compares two values and updates the Z, N and C flags accordingly
 func (reg *Registers) cmp(a, b uint8) {
-	reg.P = setFlag(reg.P, C, a >= b)
-	reg.P = setFlag(reg.P, Z, a == b)
-	reg.P = setFlag(reg.P, N, (a-b)&0x80 == 0x80)
+	reg.SetCarry(a >= b)
+	reg.SetZero(a == b)
+	reg.SetNegative((a-b)&0x80 == 0x80)
 }
 
 func (reg *Registers) String() string {
@@ -108,6 +359,20 @@ const (
 	N                   // Negative, 1 = true
 )
 
+// BusAccess is a single memory access by the CPU
+type BusAccess struct {
+	Addr  uint16
+	Value uint8
+	Write bool
+}
+
+func (a BusAccess) String() string {
+	if a.Write {
+		return fmt.Sprintf("%02X→%04X", a.Value, a.Addr)
+	}
+	return fmt.Sprintf("%04X→%02X", a.Addr, a.Value)
+}
+
 // Interrupt type
 type Interrupt uint8
 
@@ -117,3 +382,30 @@ const (
 	NMI                   // Non-Maskable interrupt
 	IRQ                   // Interrupt request
 )
+
+// HaltReason describes why the CPU halted
+type HaltReason uint8
+
+// Halt reasons
+const (
+	NotHalted              HaltReason = iota // Running
+	HaltInstruction                          // HLT (KIL) instruction
+	HaltIllegalAddressMode                   // Opcode with an invalid address mode
+	HaltIllegalOpcode                        // Undocumented opcode, see Model.StrictLegal
+	HaltMonitor                              // Monitor returned false
+)
+
+var haltReasonName = map[HaltReason]string{
+	NotHalted:              "not halted",
+	HaltInstruction:        "halt instruction",
+	HaltIllegalAddressMode: "illegal address mode",
+	HaltIllegalOpcode:      "illegal opcode",
+	HaltMonitor:            "monitor",
+}
+
+func (reason HaltReason) String() string {
+	if s, ok := haltReasonName[reason]; ok {
+		return s
+	}
+	return fmt.Sprintf("halt reason %d", reason)
+}
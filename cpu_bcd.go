@@ -2,59 +2,96 @@ package mos65xx
 
 // adc calculation
 func adc(a, b uint8, carry, bcd bool) (r uint8, n, v, z, c bool) {
-	t := uint16(a) + uint16(b)
+	var ci int
 	if carry {
-		t++
+		ci = 1
 	}
 
-	if bcd {
-		lo := (a & 0x0f) + (b & 0x0f)
-		if carry {
-			lo++
-		}
-		if lo > 0x09 {
-			t += 0x06
-		}
-		if t > 0x99 {
-			t += 0x60
-		}
-		carry = t > 0x99
-	} else {
-		carry = t&0xff00 != 0
+	t := int(a) + int(b) + ci
+	if !bcd {
+		r = uint8(t)
+		n = r&0x80 == 0x80
+		v = overflow(a, b, r)
+		z = r == 0
+		c = t > 0xff
+		return
+	}
+
+	// See http://www.6502.org/tutorials/decimal_mode.html#A, Z is based on
+	// the binary result, N and V on the result before the high nibble is
+	// adjusted
+	z = uint8(t) == 0
+
+	lo := int(a&0x0f) + int(b&0x0f) + ci
+	if lo >= 0x0a {
+		lo = ((lo + 0x06) & 0x0f) + 0x10
+	}
+	t = int(a&0xf0) + int(b&0xf0) + lo
+	n = t&0x80 == 0x80
+	v = overflow(a, b, uint8(t))
+	if t >= 0xa0 {
+		t += 0x60
 	}
 
 	r = uint8(t)
-	n = r&0x80 == 0x80
-	v = overflow(a, b, r)
-	z = r == 0
-	c = carry
+	c = t > 0xff
 	return
 }
 
 // sbc calculation
 func sbc(a, b uint8, carry, bcd bool) (r uint8, n, v, z, c bool) {
-	t := uint16(a) - uint16(b)
+	var borrow int
 	if !carry {
-		t--
+		borrow = 1
 	}
 
+	// Flags are based on the binary result, also in decimal mode
+	t := int(a) - int(b) - borrow
+	r = uint8(t)
+	n = r&0x80 == 0x80
+	v = underflow(a, b, r)
+	z = r == 0
+	c = t >= 0
+
 	if bcd {
-		lo := (a & 0x0f) - (b & 0x0f)
-		if !carry {
-			lo--
-		}
-		if lo&0xf0 != 0 {
-			t -= 0x06
+		lo := int(a&0x0f) - int(b&0x0f) - borrow
+		if lo < 0 {
+			lo = ((lo - 0x06) & 0x0f) - 0x10
 		}
-		if t > 0x99 {
+		t = int(a&0xf0) - int(b&0xf0) + lo
+		if t < 0 {
 			t -= 0x60
 		}
+		r = uint8(t)
 	}
+	return
+}
 
-	r = uint8(t)
+// arr calculation, the undocumented AND followed by ROR
+func arr(a, b uint8, carry, bcd bool) (r uint8, n, v, z, c bool) {
+	t := a & b
+	r = t >> 1
+	if carry {
+		r |= 0x80
+	}
+
+	// N and Z are based on the rotated result, V is bit 6 xor bit 5 of it
 	n = r&0x80 == 0x80
-	v = underflow(a, b, r)
 	z = r == 0
-	c = t < 0x100
+	v = (r^r<<1)&0x40 == 0x40
+	if !bcd {
+		c = r&0x40 == 0x40
+		return
+	}
+
+	// In decimal mode each nibble of the AND result is adjusted if it exceeds
+	// 5 (rounded up to even), the high nibble adjustment sets C
+	if lo := t & 0x0f; lo+lo&1 > 5 {
+		r = r&0xf0 | (r+0x06)&0x0f
+	}
+	if hi := t >> 4; hi+hi&1 > 5 {
+		r += 0x60
+		c = true
+	}
 	return
 }
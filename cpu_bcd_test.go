@@ -0,0 +1,46 @@
+package mos65xx
+
+import "testing"
+
+func TestDecimalMode(t *testing.T) {
+	for _, test := range []struct {
+		Op    string
+		A, B  uint8
+		Carry bool
+		R     uint8
+		P     uint8 // N, V, Z and C
+	}{
+		{"ADC", 0x09, 0x01, false, 0x10, 0},
+		{"ADC", 0x99, 0x01, false, 0x00, N | C},
+		{"ADC", 0x00, 0x99, true, 0x00, N | C}, // Z is based on the binary result
+		{"ADC", 0x79, 0x00, true, 0x80, N | V},
+		{"ADC", 0x00, 0x9a, false, 0x00, N | C}, // Invalid BCD operand
+		{"SBC", 0x10, 0x01, true, 0x09, C},
+		{"SBC", 0x00, 0x01, true, 0x99, N},
+		{"SBC", 0x00, 0x21, true, 0x79, N}, // N is based on the binary result
+		{"SBC", 0x32, 0x32, true, 0x00, Z | C},
+		{"SBC", 0x00, 0x0a, false, 0x9f, N}, // Invalid BCD operand
+		{"SBC", 0x10, 0x0f, true, 0x0b, C},  // Low nibble borrow, binary carry
+		{"SBC", 0x80, 0x01, true, 0x79, V | C},
+	} {
+		var (
+			r          uint8
+			n, v, z, c bool
+		)
+		switch test.Op {
+		case "ADC":
+			r, n, v, z, c = adc(test.A, test.B, test.Carry, true)
+		case "SBC":
+			r, n, v, z, c = sbc(test.A, test.B, test.Carry, true)
+		}
+		var p uint8
+		p = setFlag(p, N, n)
+		p = setFlag(p, V, v)
+		p = setFlag(p, Z, z)
+		p = setFlag(p, C, c)
+		if r != test.R || p != test.P {
+			t.Errorf("%s $%02X, $%02X with carry %t: expected $%02X (%s), got $%02X (%s)",
+				test.Op, test.A, test.B, test.Carry, test.R, fmtP(test.P), r, fmtP(p))
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package mos65xx
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -12,44 +13,117 @@ import (
 type fast struct {
 	reg     *Registers
 	bus     memory.Memory // External memory
+	flat    memory.RAM    // Bus memory, if it is a single 64kB RAM
 	ram     *memory.RAM   // Internal memory
 	ramSize int
-	ramMask uint16
+
+	stackBase   uint16
+	nmiVector   uint16
+	resetVector uint16
+	irqVector   uint16
 
 	// https://hashrocket.com/blog/posts/switch-vs-map-which-is-the-better-way-to-branch-in-go
 	//ops     map[Mnemonic]func(uint16)
+	// A switch was no faster than this table, see BenchmarkDispatch
 	ops     [mnemonics]func(uint16)
 	monitor Monitor
+	raw     [3]byte // Instruction.Raw buffer for the monitor
+	events  events
+
+	accesses   []BusAccess
+	lastAccess BusAccess // Last access during execution, survives Step
+	recording  bool
+	reads      int64 // Recorded bus reads
+	writes     int64 // Recorded bus writes
 
 	interrupt   Interrupt
-	cycles      int
-	halted      bool
+	code        uint8 // Current opcode
+	cycles      int64
+	executed    int64 // Instructions
+	halt        HaltReason
+	haltPC      uint16
+	haltOpcode  uint8
+	onHalt      func(HaltReason, uint16)
+	onTrap      func(uint16)
+	clock       Clock
+	ppuPosition func() (int, int)
 	addressMode AddressMode
+	pageCrossed bool // Page cross penalty applied in the last Step
 
 	hasBCD   bool
 	hasNMI   bool
 	hasIRQ   bool
 	hasReady bool
 	notReady bool
+	inReset  bool // RES line held
+
+	dummyReads  bool
+	dummyWrites bool
+	strictLegal bool
+
+	pollInterrupts bool
+	pollI          uint8 // I flag at the last interrupt polling point
+	irqAfter       int   // Instructions until IRQAfter fires, -1 if unset
+	nmiAfter       int   // Instructions until NMIAfter fires, -1 if unset
+
+	hasIOPort bool
+	portDDR   uint8 // I/O port data direction, 1 is output
+	portData  uint8 // I/O port data register
+	portInput uint8 // I/O port input level
+
+	cache   *decodeCache // Optional, see CacheDecoding
+	history *History     // Optional, see RecordHistory
 }
 
-// New creates a new CPU for the specified model
+// New creates a new CPU for the specified model, it panics if the model is
+// not valid.
 func New(model Model, mem memory.Memory) CPU {
+	if err := model.Validate(); err != nil {
+		panic(err)
+	}
+
 	cpu := &fast{
 		reg:      new(Registers),
 		bus:      mem,
 		ramSize:  model.InternalMemory,
-		ramMask:  uint16(model.InternalMemory - 1),
 		hasBCD:   model.HasBCD,
 		hasNMI:   model.HasNMI,
 		hasIRQ:   model.HasIRQ,
 		hasReady: model.HasReady,
+
+		stackBase:   model.StackBase,
+		nmiVector:   model.NMIVector,
+		resetVector: model.ResetVector,
+		irqVector:   model.IRQVector,
+		dummyReads:  model.DummyReads,
+		dummyWrites: model.DummyWrites,
+		strictLegal: model.StrictLegal,
+
+		pollInterrupts: model.PollInterrupts,
+		hasIOPort:      model.HasIOPort,
+		clock:          RealClock,
 	}
 
-	if cpu.ramSize > 0 {
-		cpu.ram = memory.New(int(cpu.ramSize)).Reset(0xff)
+	if cpu.stackBase == 0 {
+		cpu.stackBase = DefaultStackBase
+	}
+	if cpu.nmiVector == 0 {
+		cpu.nmiVector = NMIVector
+	}
+	if cpu.resetVector == 0 {
+		cpu.resetVector = ResetVector
+	}
+	if cpu.irqVector == 0 {
+		cpu.irqVector = IRQVector
 	}
 
+	if model.ExternalMemory > 0 && model.ExternalMemory < 0x10000 {
+		// Address lines that are not connected
+		cpu.bus = memory.Masked{Memory: mem, Mask: uint16(model.ExternalMemory - 1)}
+	}
+
+	cpu.setRAM(model.InternalMemory)
+
 	cpu.ops = [mnemonics]func(uint16){
 		cpu.adc,
 		cpu.and,
@@ -134,22 +208,112 @@ func New(model Model, mem memory.Memory) CPU {
 }
 
 // Fetch a byte from RAM or the address bus
-func (cpu *fast) Fetch(addr uint16) uint8 {
-	if cpu.ramSize > 0 && int(addr) < cpu.ramSize {
-		return cpu.ram.Fetch(addr)
+func (cpu *fast) Fetch(addr uint16) (value uint8) {
+	value = cpu.peek(addr)
+	if cpu.recording {
+		cpu.lastAccess = BusAccess{Addr: addr, Value: value}
+		cpu.accesses = append(cpu.accesses, cpu.lastAccess)
+		cpu.reads++
 	}
-	return cpu.bus.Fetch(addr)
+	return
 }
 
 // Store a byte in RAM or the address bus
 func (cpu *fast) Store(addr uint16, value uint8) {
-	if cpu.ramSize > 0 && int(addr) < cpu.ramSize {
+	if cpu.history != nil {
+		cpu.history.store(addr)
+	}
+	if cpu.recording {
+		cpu.lastAccess = BusAccess{Addr: addr, Value: value, Write: true}
+		cpu.accesses = append(cpu.accesses, cpu.lastAccess)
+		cpu.writes++
+	}
+	cpu.poke(addr, value)
+}
+
+// peek reads a byte without recording the access
+func (cpu *fast) peek(addr uint16) uint8 {
+	if addr < 2 && cpu.hasIOPort {
+		if addr == 0 {
+			return cpu.portDDR
+		}
+		return cpu.PortOutput()
+	}
+	return cpu.peekBus(addr)
+}
+
+// peekBus reads a byte from memory, bypassing the I/O port
+func (cpu *fast) peekBus(addr uint16) uint8 {
+	if cpu.flat != nil {
+		return cpu.flat[addr]
+	} else if cpu.ramSize > 0 && int(addr) < cpu.ramSize {
+		return cpu.ram.Fetch(addr)
+	}
+	return cpu.bus.Fetch(addr)
+}
+
+// poke stores a byte without recording the access
+func (cpu *fast) poke(addr uint16, value uint8) {
+	if addr < 2 && cpu.hasIOPort {
+		if addr == 0 {
+			cpu.portDDR = value
+		} else {
+			cpu.portData = value
+		}
+		if cpu.cache != nil {
+			// The port may switch banks
+			cpu.cache.flush()
+		}
+	}
+	cpu.pokeBus(addr, value)
+}
+
+// pokeBus writes a byte to memory, bypassing the I/O port
+func (cpu *fast) pokeBus(addr uint16, value uint8) {
+	if cpu.cache != nil {
+		cpu.cache.invalidate(addr)
+	}
+	if cpu.flat != nil {
+		cpu.flat[addr] = value
+	} else if cpu.ramSize > 0 && int(addr) < cpu.ramSize {
 		cpu.ram.Store(addr, value)
 	} else {
 		cpu.bus.Store(addr, value)
 	}
 }
 
+// setRAM allocates the internal RAM, keeping the contents that still fit
+func (cpu *fast) setRAM(size int) {
+	ram := memory.New(size).Reset(0xff)
+	if cpu.ram != nil {
+		copy(*ram, *cpu.ram)
+	}
+	cpu.ram, cpu.ramSize, cpu.flat = nil, size, nil
+	if size > 0 {
+		cpu.ram = ram
+	}
+
+	if ram, ok := cpu.bus.(*memory.RAM); ok && len(*ram) == 0x10000 && cpu.ramSize == 0 {
+		// Fast path bypassing the memory interface
+		cpu.flat = *ram
+	}
+	if cpu.cache != nil {
+		cpu.cache.flush()
+	}
+}
+
+// SetInternalRAM resizes the internal RAM while the CPU is stopped
+func (cpu *fast) SetInternalRAM(size int) error {
+	if cpu.halt == NotHalted && !cpu.notReady && !cpu.inReset {
+		return errors.New("mos65xx: internal RAM can only be changed while stopped")
+	}
+	if !validMemorySize(size) {
+		return fmt.Errorf("mos65xx: internal memory size %d is not a power of two up to 64kB", size)
+	}
+	cpu.setRAM(size)
+	return nil
+}
+
 // ReadAt reads a portion of the memory
 func (cpu *fast) ReadAt(p []byte, offs int64) (n int, err error) {
 	if offs < 0 || offs > math.MaxUint16 {
@@ -179,7 +343,7 @@ func (cpu *fast) ReadAt(p []byte, offs int64) (n int, err error) {
 
 // Push a byte onto the stack
 func (cpu *fast) Push(value uint8) {
-	cpu.Store(0x0100|uint16(cpu.reg.S), value)
+	cpu.Store(cpu.stackBase|uint16(cpu.reg.S), value)
 	cpu.reg.S--
 }
 
@@ -192,7 +356,7 @@ func (cpu *fast) PushWord(value uint16) {
 // Pull a byte from the stack
 func (cpu *fast) Pull() uint8 {
 	cpu.reg.S++
-	return cpu.Fetch(0x0100 | uint16(cpu.reg.S))
+	return cpu.Fetch(cpu.stackBase | uint16(cpu.reg.S))
 }
 
 // PullWord pulls a word from the stack
@@ -204,6 +368,48 @@ func (cpu *fast) PullWord() uint16 {
 	return (hi << 8) | lo
 }
 
+// AddressBusValue returns the address of the last bus access
+func (cpu *fast) AddressBusValue() uint16 { return cpu.lastAccess.Addr }
+
+// DataBusValue returns the value of the last bus access
+func (cpu *fast) DataBusValue() uint8 { return cpu.lastAccess.Value }
+
+// StackBase returns the base address of the stack page
+func (cpu *fast) StackBase() uint16 { return cpu.stackBase }
+
+// ZeroPage returns a copy of the zero page
+func (cpu *fast) ZeroPage() [256]byte { return cpu.page(0x0000) }
+
+// Stack returns a copy of the stack page
+func (cpu *fast) Stack() [256]byte { return cpu.page(cpu.stackBase) }
+
+// PeekStack returns the byte at depth above the stack pointer
+func (cpu *fast) PeekStack(depth uint8) uint8 {
+	return cpu.Fetch(cpu.stackBase | uint16(cpu.reg.S+depth))
+}
+
+// PokeStack stores a byte at depth above the stack pointer
+func (cpu *fast) PokeStack(depth, value uint8) {
+	cpu.Store(cpu.stackBase|uint16(cpu.reg.S+depth), value)
+}
+
+// page copies the page at base
+func (cpu *fast) page(base uint16) (p [256]byte) {
+	for i := range p {
+		p[i] = cpu.Fetch(base | uint16(i))
+	}
+	return
+}
+
+// Accesses returns the bus accesses performed by the last Step
+func (cpu *fast) Accesses() []BusAccess { return cpu.accesses }
+
+// BusReads returns the number of recorded bus reads
+func (cpu *fast) BusReads() int64 { return cpu.reads }
+
+// BusWrites returns the number of recorded bus writes
+func (cpu *fast) BusWrites() int64 { return cpu.writes }
+
 // Registers returns a pointer to the CPU registers
 func (cpu *fast) Registers() *Registers {
 	return cpu.reg
@@ -225,14 +431,92 @@ func (cpu *fast) NMI() {
 	cpu.interrupt = NMI
 }
 
+// IRQAfter requests an interrupt after n instructions
+func (cpu *fast) IRQAfter(n int) { cpu.irqAfter = clampAfter(n) }
+
+// NMIAfter requests a non-maskable interrupt after n instructions
+func (cpu *fast) NMIAfter(n int) { cpu.nmiAfter = clampAfter(n) }
+
+// clampAfter treats a negative count as 0
+func clampAfter(n int) int {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// InterruptPending returns the pending interrupt
+func (cpu *fast) InterruptPending() Interrupt { return cpu.interrupt }
+
+// InterruptsMasked returns true if the I flag is set
+func (cpu *fast) InterruptsMasked() bool { return cpu.reg.IRQDisabled() }
+
+// PowerOn resets the CPU to the power-on state
+func (cpu *fast) PowerOn() {
+	cpu.reg.A, cpu.reg.X, cpu.reg.Y = 0, 0, 0
+	cpu.ResetKeepPC()
+
+	cpu.reg.S = 0x00
+	cpu.resetStack()
+	cpu.reg.PC = FetchWord(cpu, cpu.resetVector)
+}
+
+// resetStack performs the stack reads of the reset sequence
+func (cpu *fast) resetStack() {
+	// The reset sequence reads the stack instead of pushing PC and P
+	for i := 0; i < 3; i++ {
+		cpu.Fetch(cpu.stackBase | uint16(cpu.reg.S))
+		cpu.reg.S--
+	}
+}
+
+// SetPortInput sets the level of the I/O port input pins
+func (cpu *fast) SetPortInput(value uint8) { cpu.portInput = value }
+
+// PortOutput returns the level of the I/O port pins
+func (cpu *fast) PortOutput() uint8 {
+	if !cpu.hasIOPort {
+		return 0
+	}
+	return cpu.portData&cpu.portDDR | cpu.portInput&^cpu.portDDR
+}
+
+// SupportsBCD returns true if the model has decimal mode
+func (cpu *fast) SupportsBCD() bool { return cpu.hasBCD }
+
 // Reset requests a cold reset
 func (cpu *fast) Reset() {
-	cpu.reg.PC = FetchWord(cpu, ResetVector)
+	s := cpu.reg.S
+	cpu.ResetKeepPC()
+	if cpu.dummyReads {
+		cpu.reg.S = s
+		cpu.resetStack()
+	}
+	cpu.reg.PC = FetchWord(cpu, cpu.resetVector)
+}
+
+// ResetKeepPC resets the CPU without loading PC from the reset vector
+func (cpu *fast) ResetKeepPC() {
 	cpu.reg.S = 0xfd
 	cpu.reg.P = 0x34
+	cpu.pollI = I
 	cpu.interrupt = None
-	cpu.halted = false
+	cpu.irqAfter = -1
+	cpu.nmiAfter = -1
+	cpu.portDDR = 0x00
+	cpu.portData = 0x00
+	cpu.portInput = 0xff
+	cpu.halt = NotHalted
 	cpu.notReady = false
+	cpu.ResetCycles()
+}
+
+// SetReset drives the reset line, the CPU resets when it is released
+func (cpu *fast) SetReset(asserted bool) {
+	if cpu.inReset && !asserted {
+		cpu.Reset()
+	}
+	cpu.inReset = asserted
 }
 
 // Ready
@@ -244,64 +528,346 @@ func (cpu *fast) Ready(on bool) {
 }
 
 // Run until halted
-func (cpu *fast) Run() int {
-	cpu.cycles = 0
-	cpu.halted = false
-	for !cpu.halted {
+func (cpu *fast) Run() int64 {
+	start := cpu.cycles
+	cpu.halt = NotHalted
+	for cpu.halt == NotHalted {
+		if cpu.Step() == 0 {
+			break
+		}
+	}
+	return cpu.cycles - start
+}
+
+// RunUntilHalt runs until halted, stuck or maxCycles have been spent
+func (cpu *fast) RunUntilHalt(maxCycles int) (int, bool) {
+	start := cpu.cycles
+	cpu.halt = NotHalted
+	for cpu.halt == NotHalted {
+		if maxCycles > 0 && cpu.cycles-start >= int64(maxCycles) {
+			break
+		}
+		pc := cpu.reg.PC
+		if cpu.Step() == 0 {
+			break
+		}
+		if cpu.reg.PC == pc && cpu.halt == NotHalted && cpu.stuck() {
+			break
+		}
+	}
+	return int(cpu.cycles - start), cpu.halt != NotHalted
+}
+
+// stuck checks if nothing is scheduled that could end a self-loop
+func (cpu *fast) stuck() bool {
+	return len(cpu.events) == 0 && cpu.irqAfter < 0 && cpu.nmiAfter < 0
+}
+
+// StepOut steps until the current subroutine or interrupt handler returns
+func (cpu *fast) StepOut(limit int) int {
+	var (
+		start = cpu.cycles
+		entry = cpu.reg.S
+	)
+	for cpu.halt == NotHalted && !cpu.notReady && !cpu.inReset {
+		cpu.Step()
+		// The stack pointer rising above the entry level means the return
+		// address of the current frame was pulled
+		if m := opcodes[cpu.code].Mnemonic; (m == RTS || m == RTI) && int8(cpu.reg.S-entry) > 0 {
+			break
+		}
+		if limit > 0 && cpu.cycles-start >= int64(limit) {
+			break
+		}
+	}
+	return int(cpu.cycles - start)
+}
+
+// Trace steps up to n instructions, returning the executed instructions
+func (cpu *fast) Trace(n int) []Instruction {
+	if n <= 0 {
+		return nil
+	}
+	var (
+		attached = cpu.monitor
+		trace    = &tracer{next: attached, trace: make([]Instruction, 0, n)}
+	)
+	cpu.monitor = trace
+	defer func() { cpu.monitor = attached }()
+
+	for i := 0; i < n && !cpu.Halted(); i++ {
 		cpu.Step()
 	}
-	return cpu.cycles
+	return trace.trace
+}
+
+// StepInstruction steps and returns the instruction and cycles
+func (cpu *fast) StepInstruction() (in Instruction, cycles int) {
+	var (
+		trace    = &tracer{next: cpu.monitor, trace: make([]Instruction, 0, 1)}
+		executed = cpu.executed
+	)
+	cpu.monitor = trace
+	cycles = cpu.Step()
+	cpu.monitor = trace.next
+	if cpu.executed > executed && len(trace.trace) > 0 {
+		in = trace.trace[0]
+	}
+	return
+}
+
+// Cycles returns the total number of cycles since the last reset
+func (cpu *fast) Cycles() int64 { return cpu.cycles }
+
+// Instructions returns the number of instructions executed since the last
+// reset
+func (cpu *fast) Instructions() int64 { return cpu.executed }
+
+// ResetCycles zeroes the cycle and instruction counters
+func (cpu *fast) ResetCycles() {
+	// Scheduled events are relative to the cycle counter
+	for _, e := range cpu.events {
+		e.at -= cpu.cycles
+	}
+	cpu.cycles = 0
+	cpu.executed = 0
+	cpu.reads = 0
+	cpu.writes = 0
 }
 
 // Step one instruction
 func (cpu *fast) Step() int {
-	// RDY line
-	if cpu.notReady {
+	// RDY and RES lines
+	if cpu.notReady || cpu.inReset {
 		return 0
 	}
 
+	if cpu.history != nil {
+		cpu.history.begin()
+	}
+	cpu.accesses = cpu.accesses[:0]
+	cpu.recording = true
+	cpu.pageCrossed = false
+
+	if cpu.irqAfter == 0 {
+		cpu.irqAfter = -1
+		cpu.IRQ()
+	}
+	if cpu.nmiAfter == 0 {
+		cpu.nmiAfter = -1
+		cpu.NMI()
+	}
 	cpu.handleInterrupts()
 
 	var (
 		start  = cpu.cycles
-		opcode = cpu.nextOpcode()
+		entry  *decoded
+		opcode opcode
 	)
+	if cpu.cache != nil {
+		entry = cpu.cache.lookup(cpu.reg.PC)
+	}
+	if entry != nil {
+		cpu.code = entry.code
+		opcode = opcodes[cpu.code]
+	} else {
+		opcode = cpu.nextOpcode()
+	}
+
+	if cpu.strictLegal && !documented(cpu.code) {
+		cpu.recording = false
+		cpu.stop(HaltIllegalOpcode)
+		return 0
+	}
 
 	if cpu.monitor != nil {
-		raw := make([]byte, opcode.Size)
-		cpu.ReadAt(raw, int64(cpu.reg.PC))
-
-		if !cpu.monitor.BeforeExecute(cpu, Instruction{
-			CPU:         cpu,
-			Cycles:      cpu.cycles,
-			Mnemonic:    opcode.Mnemonic,
-			Registers:   *cpu.reg,
-			AddressMode: opcode.Mode,
-			Raw:         raw,
-		}) {
+		cpu.recording = false
+		if !cpu.monitor.BeforeExecute(cpu, cpu.decode(opcode, cpu.raw[:opcode.Size])) {
+			cpu.stop(HaltMonitor)
 			return 0
 		}
+		// The monitor may have patched the opcode, operands are read later
+		cpu.code = cpu.Fetch(cpu.reg.PC)
+		opcode = opcodes[cpu.code]
+		if entry != nil && (!entry.valid || entry.code != cpu.code) {
+			entry = nil
+		}
+		cpu.recording = true
+	}
+
+	if cpu.onTrap != nil {
+		cpu.recording = false
+		if cpu.decode(opcode, cpu.raw[:opcode.Size]).trapped() {
+			cpu.onTrap(cpu.reg.PC)
+		}
+		cpu.recording = true
 	}
 
 	cpu.addressMode = opcode.Mode
 
-	pageCrossed, addr := cpu.resolveAddr()
+	var (
+		pageCrossed bool
+		addr        uint16
+	)
+	if entry != nil && entry.static {
+		addr = entry.addr
+	} else {
+		pageCrossed, addr = cpu.resolveAddr()
+		if entry == nil && cpu.cache != nil {
+			cpu.cache.fill(cpu.reg.PC, cpu.code, addr)
+		}
+	}
+	if cpu.halt != NotHalted {
+		cpu.recording = false
+		return int(cpu.cycles - start)
+	}
 	if pageCrossed {
-		cpu.cycles += opcode.PageCrossCycles
+		cpu.cycles += int64(opcode.PageCrossCycles)
+		cpu.pageCrossed = opcode.PageCrossCycles > 0
+	}
+	if cpu.dummyReads && (pageCrossed || writesMemory(opcode.Mnemonic)) {
+		cpu.dummyRead(addr)
 	}
 
+	mask := cpu.reg.P & I
 	cpu.reg.PC += uint16(opcode.Size)
 	cpu.ops[opcode.Mnemonic](addr)
-	cpu.cycles += opcode.Cycles
+	cpu.cycles += int64(opcode.Cycles)
+	cpu.executed++
+	if cpu.irqAfter > 0 {
+		cpu.irqAfter--
+	}
+	if cpu.nmiAfter > 0 {
+		cpu.nmiAfter--
+	}
 
-	return cpu.cycles - start
+	// The interrupt lines are polled before CLI, SEI and PLP update I
+	switch opcode.Mnemonic {
+	case CLI, SEI, PLP:
+		cpu.pollI = mask
+	default:
+		cpu.pollI = cpu.reg.P & I
+	}
+
+	cpu.recording = false
+	cpu.handleEvents()
+
+	return int(cpu.cycles - start)
+}
+
+// NextInstruction decodes the instruction at PC without executing it
+func (cpu *fast) NextInstruction() Instruction {
+	op := opcodes[cpu.Fetch(cpu.reg.PC)]
+	return cpu.decode(op, make([]byte, op.Size))
+}
+
+// decode the instruction at PC into raw
+func (cpu *fast) decode(op opcode, raw []byte) Instruction {
+	for i := range raw {
+		raw[i] = cpu.Fetch(cpu.reg.PC + uint16(i))
+	}
+	return Instruction{
+		CPU:             cpu,
+		Cycles:          cpu.cycles,
+		Mnemonic:        op.Mnemonic,
+		Registers:       cpu.reg.Clone(),
+		AddressMode:     op.Mode,
+		Size:            int(op.Size),
+		BaseCycles:      int(op.Cycles),
+		PageCrossCycles: int(op.PageCrossCycles),
+		Raw:             raw,
+	}
 }
 
-func (cpu *fast) Halted() bool { return cpu.halted }
+func (cpu *fast) Halted() bool { return cpu.halt != NotHalted }
+
+// LastPageCrossed returns true if the last Step applied a page cross penalty
+func (cpu *fast) LastPageCrossed() bool { return cpu.pageCrossed }
+
+// HaltReason returns why the CPU halted
+func (cpu *fast) HaltReason() HaltReason { return cpu.halt }
+
+// HaltedAt returns the address and opcode of the instruction that halted the
+// CPU
+func (cpu *fast) HaltedAt() (pc uint16, opcode uint8) {
+	return cpu.haltPC, cpu.haltOpcode
+}
+
+// stop halts the CPU at the current instruction
+func (cpu *fast) stop(reason HaltReason) {
+	cpu.halt = reason
+	cpu.haltPC = cpu.reg.PC
+	cpu.haltOpcode = cpu.code
+	if cpu.onHalt != nil {
+		cpu.onHalt(reason, cpu.haltPC)
+	}
+}
+
+// OnHalt sets the function called when the CPU halts
+func (cpu *fast) OnHalt(fn func(reason HaltReason, pc uint16)) { cpu.onHalt = fn }
+
+// OnTrap sets the function called when the CPU jumps or branches to itself
+func (cpu *fast) OnTrap(fn func(pc uint16)) { cpu.onTrap = fn }
+
+// WithClock replaces the clock, nil restores RealClock
+func (cpu *fast) WithClock(clock Clock) {
+	if clock == nil {
+		clock = RealClock
+	}
+	cpu.clock = clock
+}
+
+// Clock returns the clock
+func (cpu *fast) Clock() Clock { return cpu.clock }
+
+// SetPPUPosition sets the function providing the PPU position
+func (cpu *fast) SetPPUPosition(fn func() (scanline, dot int)) { cpu.ppuPosition = fn }
+
+// PPUPosition returns the PPU position, if there is a function for it
+func (cpu *fast) PPUPosition() (scanline, dot int, ok bool) {
+	if cpu.ppuPosition == nil {
+		return 0, 0, false
+	}
+	scanline, dot = cpu.ppuPosition()
+	return scanline, dot, true
+}
+
+// CacheDecoding declares a region in which decoded instructions are cached
+func (cpu *fast) CacheDecoding(start, end uint16) {
+	if cpu.cache == nil {
+		cpu.cache = new(decodeCache)
+	}
+	region := [2]uint16{start, end}
+	for _, r := range cpu.cache.regions {
+		if r == region {
+			cpu.cache.flush()
+			return
+		}
+	}
+	cpu.cache.regions = append(cpu.cache.regions, region)
+	cpu.cache.flush()
+}
 
 // Attach a monitor
 func (cpu *fast) Attach(m Monitor) { cpu.monitor = m }
 
+// ScheduleAfter schedules fn to run after the number of cycles
+func (cpu *fast) ScheduleAfter(cycles int, fn func()) *Event {
+	if cycles < 1 {
+		// Events due now would keep handleEvents busy if rescheduled
+		cycles = 1
+	}
+	e := &Event{at: cpu.cycles + int64(cycles), fn: fn}
+	cpu.events = cpu.events.insert(e)
+	return e
+}
+
+// CancelScheduled removes a scheduled event
+func (cpu *fast) CancelScheduled(e *Event) (found bool) {
+	cpu.events, found = cpu.events.remove(e)
+	return
+}
+
 // Operations
 
 func (cpu *fast) handleInterrupts() {
@@ -309,13 +875,50 @@ func (cpu *fast) handleInterrupts() {
 	case NMI:
 		cpu.nmi()
 	case IRQ:
+		if cpu.pollInterrupts && cpu.pollI == I {
+			// IRQ is level triggered, it stays pending while masked
+			return
+		}
 		cpu.irq()
 	}
 	cpu.interrupt = None
 }
 
+func (cpu *fast) handleEvents() {
+	for len(cpu.events) > 0 && cpu.events[0].at <= cpu.cycles {
+		// Pop before calling, the callback may schedule new events
+		e := cpu.events[0]
+		cpu.events = cpu.events[1:]
+		e.fn()
+	}
+}
+
 func (cpu *fast) nextOpcode() opcode {
-	return opcodes[cpu.Fetch(cpu.reg.PC)]
+	cpu.code = cpu.Fetch(cpu.reg.PC)
+	return opcodes[cpu.code]
+}
+
+// dummyRead reads from the indexed address before the high byte is fixed
+func (cpu *fast) dummyRead(addr uint16) {
+	var index uint8
+	switch cpu.addressMode {
+	case AbsoluteX:
+		index = cpu.reg.X
+	case AbsoluteY, IndirectIndexed:
+		index = cpu.reg.Y
+	default:
+		return
+	}
+	cpu.Fetch((addr-uint16(index))&0xff00 | addr&0x00ff)
+}
+
+// pullDummyReads performs the reads of the byte after the opcode and of the
+// stack before the stack pointer is incremented, done by all pull instructions
+func (cpu *fast) pullDummyReads() {
+	if cpu.dummyReads {
+		cpu.Fetch(cpu.reg.PC)
+		cpu.Fetch(cpu.stackBase | uint16(cpu.reg.S))
+	}
 }
 
 func differentPage(a, b uint16) bool {
@@ -341,6 +944,7 @@ func (cpu *fast) resolveAddr() (pageCrossed bool, addr uint16) {
 		addr = uint16(cpu.Fetch(cpu.reg.PC+1) + cpu.reg.Y)
 		return
 	case Relative:
+		// Branch taken and page cross penalties are accounted in branch
 		off := uint16(cpu.Fetch(cpu.reg.PC + 1))
 		addr = cpu.reg.PC + off + 2
 		if off&0x80 == 0x80 {
@@ -361,28 +965,20 @@ func (cpu *fast) resolveAddr() (pageCrossed bool, addr uint16) {
 		pageCrossed = differentPage(src, addr)
 		return
 	case Indirect:
-		addr = FetchWord(cpu, FetchWord(cpu, cpu.reg.PC+1))
+		addr = FetchWordBug(cpu, FetchWord(cpu, cpu.reg.PC+1))
 		return
 	case IndexedIndirect:
-		addr = uint16(cpu.Fetch(cpu.reg.PC+1) + cpu.reg.X)
-		var (
-			lo = uint16(cpu.Fetch((addr)))
-			hi = uint16(cpu.Fetch((addr + 1) & 0x00ff))
-		)
-		addr = (hi << 8) | lo
+		addr = FetchWordZP(cpu, cpu.Fetch(cpu.reg.PC+1)+cpu.reg.X)
 		return
 	case IndirectIndexed:
-		addr = uint16(cpu.Fetch(cpu.reg.PC + 1))
-		var (
-			lo = uint16(cpu.Fetch((addr)))
-			hi = uint16(cpu.Fetch((addr + 1) & 0x00ff))
-		)
-		addr = (hi << 8) | lo
+		addr = FetchWordZP(cpu, cpu.Fetch(cpu.reg.PC+1))
 		pageCrossed = differentPage(addr, addr+uint16(cpu.reg.Y))
 		addr += uint16(cpu.reg.Y)
 		return
 	default:
-		panic(fmt.Sprintf("resolveAddr() called for mode %s", cpu.addressMode))
+		// Malformed opcode table entry, halt instead of crashing the host
+		cpu.stop(HaltIllegalAddressMode)
+		return
 	}
 }
 
@@ -448,8 +1044,18 @@ func (cpu *fast) tya(_ uint16) {
 
 // Increment/decrement register
 
+// modify fetches the operand of a read-modify-write instruction, writing the
+// unmodified value back if dummy writes are enabled
+func (cpu *fast) modify(addr uint16) uint8 {
+	v := cpu.Fetch(addr)
+	if cpu.dummyWrites {
+		cpu.Store(addr, v)
+	}
+	return v
+}
+
 func (cpu *fast) dec(addr uint16) {
-	v := cpu.Fetch(addr) - 1
+	v := cpu.modify(addr) - 1
 	cpu.Store(addr, v)
 	cpu.reg.setZN(v)
 }
@@ -465,7 +1071,7 @@ func (cpu *fast) dey(_ uint16) {
 }
 
 func (cpu *fast) inc(addr uint16) {
-	v := cpu.Fetch(addr) + 1
+	v := cpu.modify(addr) + 1
 	cpu.Store(addr, v)
 	cpu.reg.setZN(v)
 }
@@ -523,21 +1129,21 @@ func (cpu *fast) ora(addr uint16) {
 
 func (cpu *fast) bit(addr uint16) {
 	v := cpu.Fetch(addr)
-	cpu.reg.P = setFlag(cpu.reg.P, V, v&0x40 == 0x40)
-	cpu.reg.P = setFlag(cpu.reg.P, N, v&0x80 == 0x80)
-	cpu.reg.P = setFlag(cpu.reg.P, Z, v&cpu.reg.A == 0)
+	cpu.reg.SetOverflow(v&0x40 == 0x40)
+	cpu.reg.SetNegative(v&0x80 == 0x80)
+	cpu.reg.SetZero(v&cpu.reg.A == 0)
 }
 
 func (cpu *fast) asl(addr uint16) {
 	switch cpu.addressMode {
 	case Accumulator:
 		v := cpu.reg.A
-		cpu.reg.P = setFlag(cpu.reg.P, C, (v>>7)&1 == 1)
+		cpu.reg.SetCarry((v>>7)&1 == 1)
 		cpu.reg.A = v << 1
 		cpu.reg.setZN(cpu.reg.A)
 	default:
-		v := cpu.Fetch(addr)
-		cpu.reg.P = setFlag(cpu.reg.P, C, (v>>7)&1 == 1)
+		v := cpu.modify(addr)
+		cpu.reg.SetCarry((v>>7)&1 == 1)
 		v <<= 1
 		cpu.Store(addr, v)
 		cpu.reg.setZN(v)
@@ -548,12 +1154,12 @@ func (cpu *fast) lsr(addr uint16) {
 	switch cpu.addressMode {
 	case Accumulator:
 		v := cpu.reg.A
-		cpu.reg.P = setFlag(cpu.reg.P, C, v&1 == 1)
+		cpu.reg.SetCarry(v&1 == 1)
 		cpu.reg.A = v >> 1
 		cpu.reg.setZN(cpu.reg.A)
 	default:
-		v := cpu.Fetch(addr)
-		cpu.reg.P = setFlag(cpu.reg.P, C, v&1 == 1)
+		v := cpu.modify(addr)
+		cpu.reg.SetCarry(v&1 == 1)
 		v >>= 1
 		cpu.Store(addr, v)
 		cpu.reg.setZN(v)
@@ -562,16 +1168,16 @@ func (cpu *fast) lsr(addr uint16) {
 
 func (cpu *fast) rol(addr uint16) {
 	var v, carry uint8
-	if cpu.reg.P&C == C {
+	if cpu.reg.Carry() {
 		carry = 1
 	}
 	switch cpu.addressMode {
 	case Accumulator:
 		v = cpu.reg.A
 	default:
-		v = cpu.Fetch(addr)
+		v = cpu.modify(addr)
 	}
-	cpu.reg.P = setFlag(cpu.reg.P, C, (v>>7) == 1)
+	cpu.reg.SetCarry((v >> 7) == 1)
 	v = (v << 1) | carry
 	cpu.reg.setZN(v)
 	switch cpu.addressMode {
@@ -584,16 +1190,16 @@ func (cpu *fast) rol(addr uint16) {
 
 func (cpu *fast) ror(addr uint16) {
 	var v, carry uint8
-	if cpu.reg.P&C == C {
+	if cpu.reg.Carry() {
 		carry = 1 << 7
 	}
 	switch cpu.addressMode {
 	case Accumulator:
 		v = cpu.reg.A
 	default:
-		v = cpu.Fetch(addr)
+		v = cpu.modify(addr)
 	}
-	cpu.reg.P = setFlag(cpu.reg.P, C, v&1 == 1)
+	cpu.reg.SetCarry(v&1 == 1)
 	v = (v >> 1) | carry
 	cpu.reg.setZN(v)
 	switch cpu.addressMode {
@@ -613,26 +1219,26 @@ func (cpu *fast) adc(addr uint16) {
 	var n, v, z, c bool
 	cpu.reg.A, n, v, z, c = adc(
 		cpu.reg.A, cpu.Fetch(addr),
-		cpu.reg.P&C == C,               // carry
-		cpu.reg.P&D == D && cpu.hasBCD, // bcd
+		cpu.reg.Carry(),                 // carry
+		cpu.reg.Decimal() && cpu.hasBCD, // bcd
 	)
-	cpu.reg.P = setFlag(cpu.reg.P, N, n)
-	cpu.reg.P = setFlag(cpu.reg.P, V, v)
-	cpu.reg.P = setFlag(cpu.reg.P, Z, z)
-	cpu.reg.P = setFlag(cpu.reg.P, C, c)
+	cpu.reg.SetNegative(n)
+	cpu.reg.SetOverflow(v)
+	cpu.reg.SetZero(z)
+	cpu.reg.SetCarry(c)
 }
 
 func (cpu *fast) sbc(addr uint16) {
 	var n, v, z, c bool
 	cpu.reg.A, n, v, z, c = sbc(
 		cpu.reg.A, cpu.Fetch(addr),
-		cpu.reg.P&C == C,               // carry
-		cpu.reg.P&D == D && cpu.hasBCD, // bcd
+		cpu.reg.Carry(),                 // carry
+		cpu.reg.Decimal() && cpu.hasBCD, // bcd
 	)
-	cpu.reg.P = setFlag(cpu.reg.P, N, n)
-	cpu.reg.P = setFlag(cpu.reg.P, V, v)
-	cpu.reg.P = setFlag(cpu.reg.P, Z, z)
-	cpu.reg.P = setFlag(cpu.reg.P, C, c)
+	cpu.reg.SetNegative(n)
+	cpu.reg.SetOverflow(v)
+	cpu.reg.SetZero(z)
+	cpu.reg.SetCarry(c)
 }
 
 // Branching
@@ -644,55 +1250,56 @@ func (cpu *fast) branch(pc uint16) {
 	if differentPage(cpu.reg.PC, pc) {
 		// Page cross; add cycle
 		cpu.cycles++
+		cpu.pageCrossed = true
 	}
 
 	cpu.reg.PC = pc
 }
 
 func (cpu *fast) bcc(addr uint16) {
-	if cpu.reg.P&C == 0 {
+	if !cpu.reg.Carry() {
 		cpu.branch(addr)
 	}
 }
 
 func (cpu *fast) bcs(addr uint16) {
-	if cpu.reg.P&C == C {
+	if cpu.reg.Carry() {
 		cpu.branch(addr)
 	}
 }
 
 func (cpu *fast) bne(addr uint16) {
-	if cpu.reg.P&Z == 0 {
+	if !cpu.reg.Zero() {
 		cpu.branch(addr)
 	}
 }
 
 func (cpu *fast) beq(addr uint16) {
-	if cpu.reg.P&Z == Z {
+	if cpu.reg.Zero() {
 		cpu.branch(addr)
 	}
 }
 
 func (cpu *fast) bpl(addr uint16) {
-	if cpu.reg.P&N == 0 {
+	if !cpu.reg.Negative() {
 		cpu.branch(addr)
 	}
 }
 
 func (cpu *fast) bmi(addr uint16) {
-	if cpu.reg.P&N == N {
+	if cpu.reg.Negative() {
 		cpu.branch(addr)
 	}
 }
 
 func (cpu *fast) bvc(addr uint16) {
-	if cpu.reg.P&V == 0 {
+	if !cpu.reg.Overflow() {
 		cpu.branch(addr)
 	}
 }
 
 func (cpu *fast) bvs(addr uint16) {
-	if cpu.reg.P&V == V {
+	if cpu.reg.Overflow() {
 		cpu.branch(addr)
 	}
 }
@@ -709,34 +1316,44 @@ func (cpu *fast) jsr(addr uint16) {
 }
 
 func (cpu *fast) rti(_ uint16) {
-	cpu.reg.P = (cpu.Pull() & 0xef) | 0x20
+	cpu.pullDummyReads()
+	cpu.reg.P = cpu.Pull()&^B | U
 	cpu.reg.PC = cpu.PullWord()
 }
 
 func (cpu *fast) rts(_ uint16) {
-	cpu.reg.PC = cpu.PullWord() + 1
+	cpu.pullDummyReads()
+	cpu.reg.PC = cpu.PullWord()
+	if cpu.dummyReads {
+		// Read while incrementing the pulled address
+		cpu.Fetch(cpu.reg.PC)
+	}
+	cpu.reg.PC++
 }
 
 func (cpu *fast) brk(addr uint16) {
+	// BRK is listed with size 1 so disassemblers don't eat the next opcode,
+	// but the CPU skips the signature byte: PC points past the opcode, so the
+	// return address is the BRK address + 2
 	cpu.PushWord(cpu.reg.PC + 1)
-	cpu.Push(cpu.reg.P | 0x10) // php
-	cpu.reg.P |= I             // sei
-	cpu.reg.PC = FetchWord(cpu, IRQVector)
+	cpu.Push(cpu.reg.P | B | U) // php
+	cpu.reg.P |= I              // sei
+	cpu.reg.PC = FetchWord(cpu, cpu.irqVector)
 }
 
 func (cpu *fast) nmi() {
 	cpu.PushWord(cpu.reg.PC)
-	cpu.Push(cpu.reg.P)
+	cpu.Push(cpu.reg.P&^B | U) // B is only set for BRK and PHP
 	cpu.reg.P |= I
-	cpu.reg.PC = FetchWord(cpu, NMIVector)
+	cpu.reg.PC = FetchWord(cpu, cpu.nmiVector)
 	cpu.cycles += 7
 }
 
 func (cpu *fast) irq() {
 	cpu.PushWord(cpu.reg.PC)
-	cpu.Push(cpu.reg.P)
+	cpu.Push(cpu.reg.P&^B | U) // B is only set for BRK and PHP
 	cpu.reg.P |= I
-	cpu.reg.PC = FetchWord(cpu, IRQVector)
+	cpu.reg.PC = FetchWord(cpu, cpu.irqVector)
 	cpu.cycles += 7
 }
 
@@ -747,16 +1364,19 @@ func (cpu *fast) pha(_ uint16) {
 }
 
 func (cpu *fast) php(_ uint16) {
-	cpu.Push(cpu.reg.P | B)
+	cpu.Push(cpu.reg.P | B | U)
 }
 
 func (cpu *fast) pla(_ uint16) {
+	cpu.pullDummyReads()
 	cpu.reg.A = cpu.Pull()
 	cpu.reg.setZN(cpu.reg.A)
 }
 
 func (cpu *fast) plp(_ uint16) {
-	cpu.reg.P = (cpu.Pull() & 0xef) | 0x20
+	cpu.pullDummyReads()
+	// B only exists on the stack, U always reads as set
+	cpu.reg.P = cpu.Pull()&^B | U
 }
 
 // Misc.
@@ -765,33 +1385,35 @@ func (cpu *fast) nop(_ uint16) {}
 
 func (cpu *fast) hlt(_ uint16) {
 	cpu.reg.PC--
-	cpu.halted = true
+	cpu.stop(HaltInstruction)
 }
 
 // Undocumented
 
 func (cpu *fast) alr(addr uint16) {
-	cpu.and(addr)
-	cpu.addressMode = Accumulator
-	cpu.lsr(addr)
+	v := cpu.reg.A & cpu.Fetch(addr)
+	cpu.reg.SetCarry(v&1 == 1)
+	cpu.reg.A = v >> 1
+	cpu.reg.setZN(cpu.reg.A)
 }
 
 func (cpu *fast) anc(addr uint16) {
 	cpu.reg.A &= cpu.Fetch(addr)
 	cpu.reg.setZN(cpu.reg.A)
-	cpu.reg.P = setFlag(cpu.reg.P, C, cpu.reg.P&N == N)
+	cpu.reg.SetCarry(cpu.reg.Negative())
 }
 
 func (cpu *fast) arr(addr uint16) {
-	cpu.and(addr)
-	cpu.addressMode = Accumulator
-	cpu.ror(addr)
-	var (
-		b5 = (cpu.reg.A>>5)&1 == 1
-		b6 = (cpu.reg.A>>6)&1 == 1
+	var n, v, z, c bool
+	cpu.reg.A, n, v, z, c = arr(
+		cpu.reg.A, cpu.Fetch(addr),
+		cpu.reg.Carry(),                 // carry
+		cpu.reg.Decimal() && cpu.hasBCD, // bcd
 	)
-	cpu.reg.P = setFlag(cpu.reg.P, C, b6)
-	cpu.reg.P = setFlag(cpu.reg.P, V, b5 != b6) // XOR
+	cpu.reg.SetNegative(n)
+	cpu.reg.SetOverflow(v)
+	cpu.reg.SetZero(z)
+	cpu.reg.SetCarry(c)
 }
 
 func (cpu *fast) axs(addr uint16) {
@@ -800,7 +1422,7 @@ func (cpu *fast) axs(addr uint16) {
 		v = cpu.Fetch(addr)
 	)
 	cpu.reg.X = a - v
-	cpu.reg.P = setFlag(cpu.reg.P, C, a >= v)
+	cpu.reg.SetCarry(a >= v)
 	cpu.reg.setZN(cpu.reg.X)
 }
 
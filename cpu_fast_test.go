@@ -0,0 +1,1925 @@
+package mos65xx
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+// newTestCPU returns a CPU for model with program at $0600 in memory filled
+// with NOPs, PC points to the program
+func newTestCPU(model Model, program []byte) (CPU, *memory.RAM) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	copy((*mem)[0x0600:], program)
+	cpu := New(model, mem)
+	cpu.Registers().PC = 0x0600
+	return cpu, mem
+}
+
+func TestCycles(t *testing.T) {
+	cpu, _ := newTestCPU(MOS6502, nil)
+
+	for i := 0; i < 8; i++ {
+		cpu.Step()
+	}
+	if v := cpu.Cycles(); v != 16 {
+		t.Fatalf("expected 16 cycles, got %d", v)
+	}
+
+	cpu.ResetCycles()
+	if v := cpu.Cycles(); v != 0 {
+		t.Fatalf("expected 0 cycles after ResetCycles, got %d", v)
+	}
+	pc := cpu.Registers().PC
+	cpu.Step()
+	if v := cpu.Cycles(); v != 2 {
+		t.Fatalf("expected 2 cycles, got %d", v)
+	}
+	if cpu.Registers().PC != pc+1 {
+		t.Fatal("ResetCycles should not reset the CPU")
+	}
+
+	cpu.Reset()
+	if v := cpu.Cycles(); v != 0 {
+		t.Fatalf("expected 0 cycles after Reset, got %d", v)
+	}
+}
+
+func TestBranchCycles(t *testing.T) {
+	for _, test := range []struct {
+		Opcode uint8
+		Taken  uint8 // Status for which the branch is taken
+	}{
+		{0x10, 0}, // BPL
+		{0x30, N}, // BMI
+		{0x50, 0}, // BVC
+		{0x70, V}, // BVS
+		{0x90, 0}, // BCC
+		{0xb0, C}, // BCS
+		{0xd0, 0}, // BNE
+		{0xf0, Z}, // BEQ
+	} {
+		notTaken := test.Taken ^ (N | V | C | Z)
+		for _, branch := range []struct {
+			PC     uint16
+			P      uint8
+			Cycles int
+		}{
+			{0x0600, notTaken, 2},
+			{0x0600, test.Taken, 3},
+			{0x06f0, test.Taken, 4}, // Lands on $0702
+		} {
+			mem := memory.New(0x10000).Reset(0xea) // NOP
+			mem.Store(branch.PC, test.Opcode)
+			mem.Store(branch.PC+1, 0x10)
+			cpu := New(MOS6502, mem)
+			cpu.Registers().PC = branch.PC
+			cpu.Registers().P = branch.P
+			if v := cpu.Step(); v != branch.Cycles {
+				t.Errorf("%s at $%04X with P=%s: expected %d cycles, got %d",
+					opcodes[test.Opcode].Mnemonic, branch.PC, fmtP(branch.P), branch.Cycles, v)
+			}
+			if v := cpu.LastPageCrossed(); v != (branch.Cycles == 4) {
+				t.Errorf("%s at $%04X with P=%s: expected page crossed %t, got %t",
+					opcodes[test.Opcode].Mnemonic, branch.PC, fmtP(branch.P), branch.Cycles == 4, v)
+			}
+		}
+	}
+}
+
+func TestLastPageCrossed(t *testing.T) {
+	cpu, _ := newTestCPU(MOS6502, []byte{
+		0xbd, 0xff, 0x12, // LDA $12FF,X
+		0xbd, 0x00, 0x12, // LDA $1200,X
+		0x9d, 0xff, 0x12, // STA $12FF,X
+	})
+	cpu.Registers().X = 0x01
+
+	for _, want := range []bool{
+		true,
+		false,
+		false, // Stores always take the extra cycle, there is no penalty
+	} {
+		cpu.Step()
+		if v := cpu.LastPageCrossed(); v != want {
+			t.Fatalf("expected page crossed %t, got %t", want, v)
+		}
+	}
+}
+
+func TestDummyReads(t *testing.T) {
+	for _, test := range []struct {
+		Code   []byte
+		Reads  [2]int // Without and with dummy reads
+		Writes int
+	}{
+		{[]byte{0xbd, 0x10, 0xd0}, [2]int{1, 1}, 0}, // LDA $D010,X
+		{[]byte{0xbd, 0xff, 0xd0}, [2]int{0, 1}, 0}, // LDA $D0FF,X (dummy read at $D000)
+		{[]byte{0x9d, 0x10, 0xd0}, [2]int{0, 1}, 1}, // STA $D010,X
+		{[]byte{0xfe, 0x10, 0xd0}, [2]int{1, 2}, 1}, // INC $D010,X
+	} {
+		for i, dummyReads := range []bool{false, true} {
+			var (
+				reads, writes int
+				ram           = memory.New(0x10000).Reset(0xea) // NOP
+				mem           = memory.NewMapper()
+				model         = MOS6502
+			)
+			mem.Map(0x0000, 0xcfff, ram)
+			mem.Map(0xd000, 0xd0ff, &memory.IO{
+				Read:  func(_ uint16) uint8 { reads++; return 0 },
+				Write: func(_ uint16, _ uint8) { writes++ },
+			})
+			mem.Map(0xd100, 0xffff, ram)
+			copy((*ram)[0x0600:], test.Code)
+
+			model.DummyReads = dummyReads
+			cpu := New(model, mem)
+			cpu.Registers().PC = 0x0600
+			cpu.Registers().X = 0x01
+			cpu.Step()
+
+			if reads != test.Reads[i] || writes != test.Writes {
+				t.Errorf("% X with dummy reads %t: expected %d reads and %d writes, got %d and %d",
+					test.Code, dummyReads, test.Reads[i], test.Writes, reads, writes)
+			}
+		}
+	}
+}
+
+func TestDummyReadAccesses(t *testing.T) {
+	for _, test := range []struct {
+		Code []byte
+		Want []BusAccess
+	}{
+		{
+			[]byte{0xbd, 0xff, 0x12}, // LDA $12FF,X
+			[]BusAccess{
+				{0x0600, 0xbd, false},
+				{0x0601, 0xff, false},
+				{0x0602, 0x12, false},
+				{0x1200, 0x11, false}, // High byte not yet fixed
+				{0x1300, 0x22, false},
+			},
+		},
+		{
+			[]byte{0xbd, 0x00, 0x12}, // LDA $1200,X
+			[]BusAccess{
+				{0x0600, 0xbd, false},
+				{0x0601, 0x00, false},
+				{0x0602, 0x12, false},
+				{0x1201, 0x33, false},
+			},
+		},
+		{
+			[]byte{0x9d, 0x00, 0x12}, // STA $1200,X
+			[]BusAccess{
+				{0x0600, 0x9d, false},
+				{0x0601, 0x00, false},
+				{0x0602, 0x12, false},
+				{0x1201, 0x33, false}, // Always performed by stores
+				{0x1201, 0x00, true},
+			},
+		},
+	} {
+		model := MOS6502
+		model.DummyReads = true
+		cpu, mem := newTestCPU(model, test.Code)
+		(*mem)[0x1200] = 0x11
+		(*mem)[0x1300] = 0x22
+		(*mem)[0x1201] = 0x33
+		cpu.Registers().X = 0x01
+		cpu.Registers().A = 0x00
+		cpu.Step()
+
+		got := cpu.Accesses()
+		if len(got) != len(test.Want) {
+			t.Errorf("% X: expected accesses %v, got %v", test.Code, test.Want, got)
+			continue
+		}
+		for i := range test.Want {
+			if got[i] != test.Want[i] {
+				t.Errorf("% X: expected accesses %v, got %v", test.Code, test.Want, got)
+				break
+			}
+		}
+	}
+}
+
+func TestPullDummyReads(t *testing.T) {
+	for _, test := range []struct {
+		Code     byte
+		Accesses [2]int // Without and with dummy reads
+	}{
+		{0x68, [2]int{2, 4}}, // PLA
+		{0x28, [2]int{2, 4}}, // PLP
+		{0x40, [2]int{4, 6}}, // RTI
+		{0x60, [2]int{3, 6}}, // RTS
+	} {
+		for i, dummyReads := range []bool{false, true} {
+			model := MOS6502
+			model.DummyReads = dummyReads
+			cpu, mem := newTestCPU(model, []byte{test.Code})
+			StoreWord(mem, 0x01fc, 0x1234)
+			cpu.Registers().S = 0xfb
+			cpu.Step()
+
+			if got := cpu.Accesses(); len(got) != test.Accesses[i] {
+				t.Errorf("%s with dummy reads %t: expected %d accesses, got %v",
+					opcodes[test.Code].Mnemonic, dummyReads, test.Accesses[i], got)
+			}
+		}
+	}
+
+	// Hardware bus sequence of RTS
+	model := MOS6502
+	model.DummyReads = true
+	cpu, mem := newTestCPU(model, []byte{0x60}) // RTS
+	StoreWord(mem, 0x01fc, 0x1234)
+	cpu.Registers().S = 0xfb
+
+	cpu.Step()
+	want := []BusAccess{
+		{0x0600, 0x60, false},
+		{0x0601, 0xea, false},
+		{0x01fb, 0xea, false},
+		{0x01fc, 0x34, false},
+		{0x01fd, 0x12, false},
+		{0x1234, 0xea, false},
+	}
+	got := cpu.Accesses()
+	if len(got) != len(want) {
+		t.Fatalf("expected accesses %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected accesses %v, got %v", want, got)
+		}
+	}
+	if v := cpu.Registers().PC; v != 0x1235 {
+		t.Fatalf("expected PC=$1235, got $%04X", v)
+	}
+}
+
+func TestDummyWrites(t *testing.T) {
+	for _, test := range []struct {
+		Code  []byte
+		Value uint8 // Modified value
+	}{
+		{[]byte{0xee, 0x10, 0xd0}, 0x41}, // INC $D010
+		{[]byte{0xce, 0x10, 0xd0}, 0x3f}, // DEC $D010
+		{[]byte{0x0e, 0x10, 0xd0}, 0x80}, // ASL $D010
+		{[]byte{0x4e, 0x10, 0xd0}, 0x20}, // LSR $D010
+		{[]byte{0x2e, 0x10, 0xd0}, 0x80}, // ROL $D010
+		{[]byte{0x6e, 0x10, 0xd0}, 0x20}, // ROR $D010
+		{[]byte{0xcf, 0x10, 0xd0}, 0x3f}, // DCP $D010
+		{[]byte{0xef, 0x10, 0xd0}, 0x41}, // ISC $D010
+	} {
+		for _, dummyWrites := range []bool{false, true} {
+			var (
+				writes []uint8
+				ram    = memory.New(0x10000).Reset(0xea) // NOP
+				mem    = memory.NewMapper()
+				model  = MOS6502
+			)
+			mem.Map(0x0000, 0xcfff, ram)
+			mem.Map(0xd000, 0xd0ff, &memory.IO{
+				Read:  func(_ uint16) uint8 { return 0x40 },
+				Write: func(_ uint16, value uint8) { writes = append(writes, value) },
+			})
+			mem.Map(0xd100, 0xffff, ram)
+			copy((*ram)[0x0600:], test.Code)
+
+			model.DummyWrites = dummyWrites
+			cpu := New(model, mem)
+			cpu.Registers().PC = 0x0600
+			cpu.Registers().P &^= C
+			cpu.Step()
+
+			want := []uint8{test.Value}
+			if dummyWrites {
+				want = []uint8{0x40, test.Value}
+			}
+			if !bytes.Equal(writes, want) {
+				t.Errorf("% X with dummy writes %t: expected writes % X, got % X",
+					test.Code, dummyWrites, want, writes)
+			}
+		}
+	}
+}
+
+func TestStackBase(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	if v := New(MOS6502, mem).StackBase(); v != DefaultStackBase {
+		t.Fatalf("expected stack base $%04X, got $%04X", DefaultStackBase, v)
+	}
+
+	model := MOS6502
+	model.StackBase = 0x0200
+	cpu := New(model, mem)
+	cpu.Registers().PC = 0x0600
+	cpu.Registers().A = 0x42
+	cpu.Store(0x0600, 0x48) // PHA
+	cpu.Store(0x0601, 0x68) // PLA
+
+	s := cpu.Registers().S
+	cpu.Step()
+	if v := mem.Fetch(0x0200 | uint16(s)); v != 0x42 {
+		t.Fatalf("expected $42 at $%04X, got $%02X", 0x0200|uint16(s), v)
+	}
+	cpu.Registers().A = 0
+	cpu.Step()
+	if v := cpu.Registers().A; v != 0x42 {
+		t.Fatalf("expected A=$42 after PLA, got $%02X", v)
+	}
+}
+
+// stackReads records reads from the stack page
+type stackReads struct {
+	*memory.RAM
+	reads []uint16
+}
+
+func (mem *stackReads) Fetch(addr uint16) uint8 {
+	if addr&0xff00 == 0x0100 {
+		mem.reads = append(mem.reads, addr)
+	}
+	return mem.RAM.Fetch(addr)
+}
+
+func TestPowerOn(t *testing.T) {
+	mem := &stackReads{RAM: memory.New(0x10000).Reset(0xea)} // NOP
+	StoreWord(mem, ResetVector, 0x8000)
+
+	cpu := New(MOS6502, mem)
+	*cpu.Registers() = Registers{A: 0x11, X: 0x22, Y: 0x33, S: 0x44, P: 0xff}
+	mem.reads = nil
+	cpu.PowerOn()
+
+	if r, want := *cpu.Registers(), (Registers{PC: 0x8000, S: 0xfd, P: 0x34}); r != want {
+		t.Errorf("expected %s, got %s", &want, &r)
+	}
+	want := []uint16{0x0100, 0x01ff, 0x01fe}
+	if len(mem.reads) != len(want) {
+		t.Fatalf("expected stack reads %04X, got %04X", want, mem.reads)
+	}
+	for i, addr := range want {
+		if mem.reads[i] != addr {
+			t.Errorf("expected stack reads %04X, got %04X", want, mem.reads)
+			break
+		}
+	}
+	if cpu.Cycles() != 0 || cpu.Halted() {
+		t.Errorf("expected 0 cycles and running, got %d cycles, halted %t", cpu.Cycles(), cpu.Halted())
+	}
+
+	// Reset keeps A, X and Y
+	cpu.Registers().A = 0x42
+	cpu.Reset()
+	if r := cpu.Registers(); r.A != 0x42 || r.S != 0xfd || r.P != 0x34 {
+		t.Errorf("expected A=$42 S=$FD P=$34 after Reset, got %s", r)
+	}
+}
+
+func TestResetStackReads(t *testing.T) {
+	mem := &stackReads{RAM: memory.New(0x10000).Reset(0xea)} // NOP
+	StoreWord(mem, ResetVector, 0x8000)
+
+	dummy := MOS6502
+	dummy.Name += " with dummy reads"
+	dummy.DummyReads = true
+	for _, test := range []struct {
+		Model
+		S     uint8
+		Reads []uint16
+	}{
+		{MOS6502, 0xfd, nil},
+		{dummy, 0xf0 - 3, []uint16{0x01f0, 0x01ef, 0x01ee}},
+	} {
+		cpu := New(test.Model, mem)
+		if s := cpu.Registers().S; s != 0xfd {
+			t.Errorf("%s: expected S=$FD after power up, got $%02X", test.Name, s)
+		}
+		cpu.Registers().S = 0xf0
+		mem.reads = nil
+		cpu.Reset()
+
+		if s := cpu.Registers().S; s != test.S {
+			t.Errorf("%s: expected S=$%02X after Reset, got $%02X", test.Name, test.S, s)
+		}
+		if len(mem.reads) != len(test.Reads) {
+			t.Errorf("%s: expected stack reads %04X, got %04X", test.Name, test.Reads, mem.reads)
+			continue
+		}
+		for i, addr := range test.Reads {
+			if mem.reads[i] != addr {
+				t.Errorf("%s: expected stack reads %04X, got %04X", test.Name, test.Reads, mem.reads)
+				break
+			}
+		}
+	}
+}
+
+func TestStepInstruction(t *testing.T) {
+	cpu, _ := newTestCPU(MOS6502, []byte{
+		0xa9, 0x42, // LDA #$42
+	})
+
+	in, cycles := cpu.StepInstruction()
+	if in.Mnemonic != LDA || in.Registers.PC != 0x0600 || in.Registers.A != 0x00 || cycles != 2 {
+		t.Errorf("expected LDA at $0600 with A=$00 in 2 cycles, got %s with A=$%02X in %d cycles",
+			in, in.Registers.A, cycles)
+	}
+	if a := cpu.Registers().A; a != 0x42 {
+		t.Errorf("expected A=$42 after the step, got $%02X", a)
+	}
+
+	cpu.(*fast).stop(HaltInstruction)
+	if in, cycles = cpu.StepInstruction(); in.Raw != nil || cycles != 0 {
+		t.Errorf("expected no instruction when halted, got %s in %d cycles", in, cycles)
+	}
+}
+
+func TestPeekStack(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	cpu := New(MOS6502, mem).(*fast)
+	cpu.Registers().S = 0x01
+	cpu.PushWord(0x1234)
+
+	if v := cpu.PeekStack(1); v != 0x34 {
+		t.Errorf("expected low byte $34 at depth 1, got $%02X", v)
+	}
+	if v := cpu.PeekStack(2); v != 0x12 {
+		t.Errorf("expected high byte $12 at depth 2, got $%02X", v)
+	}
+	if s := cpu.Registers().S; s != 0xff {
+		t.Errorf("expected S=$FF, got $%02X", s)
+	}
+
+	cpu.PokeStack(2, 0x56)
+	if v := mem.Fetch(0x0101); v != 0x56 {
+		t.Errorf("expected poke to wrap to $0101, got $%02X there", v)
+	}
+	if v := cpu.PullWord(); v != 0x5634 {
+		t.Errorf("expected to pull $5634, got $%04X", v)
+	}
+}
+
+func TestStoreCycles(t *testing.T) {
+	for _, test := range []struct {
+		Name   string
+		Code   []byte
+		Cycles int
+	}{
+		{"STA $1200,X", []byte{0x9d, 0x00, 0x12}, 5},
+		{"STA $12FF,X", []byte{0x9d, 0xff, 0x12}, 5},
+		{"STA $1200,Y", []byte{0x99, 0x00, 0x12}, 5},
+		{"STA $12FF,Y", []byte{0x99, 0xff, 0x12}, 5},
+		{"STA ($10),Y", []byte{0x91, 0x10}, 6},
+		{"STA ($20),Y", []byte{0x91, 0x20}, 6},
+	} {
+		cpu, mem := newTestCPU(MOS6502, test.Code)
+		copy((*mem)[0x0010:], []byte{0x00, 0x12})
+		copy((*mem)[0x0020:], []byte{0xff, 0x12})
+		cpu.Registers().X = 0x01
+
+		cpu.Registers().Y = 0x01
+		if cycles := cpu.Step(); cycles != test.Cycles {
+			t.Errorf("%s: expected %d cycles, got %d", test.Name, test.Cycles, cycles)
+		}
+	}
+}
+
+func TestZeroPageStack(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	(*mem)[0x0012] = 0x34
+	(*mem)[0x02ff] = 0x56
+
+	model := MOS6502
+	model.StackBase = 0x0200
+	cpu := New(model, mem)
+	zp, stack := cpu.ZeroPage(), cpu.Stack()
+	if zp[0x12] != 0x34 {
+		t.Errorf("expected $34 at $12, got $%02X", zp[0x12])
+	}
+	if stack[0xff] != 0x56 {
+		t.Errorf("expected $56 at $02FF, got $%02X", stack[0xff])
+	}
+
+	// Snapshots do not follow later stores
+	cpu.Store(0x0012, 0x00)
+	if zp[0x12] != 0x34 {
+		t.Errorf("expected snapshot to keep $34, got $%02X", zp[0x12])
+	}
+}
+
+func TestBRKOrIRQ(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	copy((*mem)[0x3000:], []byte{
+		0x68,       // PLA
+		0x48,       // PHA
+		0x29, 0x10, // AND #$10
+		0x85, 0x00, // STA $00
+		0x40, // RTI
+	})
+	StoreWord(mem, IRQVector, 0x3000)
+	mem.Store(0x0600, 0x00) // BRK
+
+	for _, test := range []struct {
+		Name string
+		Do   func(CPU)
+		Want uint8 // B flag seen by the handler
+	}{
+		{"BRK", nil, B},
+		{"IRQ", CPU.IRQ, 0},
+	} {
+		cpu := New(MOS6502, mem)
+		cpu.Registers().PC = 0x0600
+		cpu.Registers().P = U // Reset sets I, which would mask the IRQ
+		mem.Store(0x0000, 0xff)
+		if test.Do != nil {
+			cpu.Registers().PC = 0x0601
+			test.Do(cpu)
+		}
+		for cpu.Registers().PC < 0x0602 || cpu.Registers().PC >= 0x3000 {
+			cpu.Step()
+		}
+		if v := mem.Fetch(0x0000); v != test.Want {
+			t.Errorf("%s: expected handler to see B=$%02X, got $%02X", test.Name, test.Want, v)
+		}
+	}
+}
+
+// handlerMonitor records the number of instructions executed before the
+// handler at $3000
+type handlerMonitor struct {
+	entered int64
+}
+
+func (m *handlerMonitor) BeforeExecute(cpu CPU, in Instruction) bool {
+	if in.Registers.PC == 0x3000 && m.entered < 0 {
+		m.entered = cpu.Instructions()
+	}
+	return true
+}
+
+func TestInterruptAfter(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	StoreWord(mem, IRQVector, 0x3000)
+	StoreWord(mem, NMIVector, 0x3000)
+
+	for _, test := range []struct {
+		Name string
+		Do   func(CPU, int)
+		N    int
+	}{
+		{"IRQAfter", CPU.IRQAfter, 0},
+		{"IRQAfter", CPU.IRQAfter, 3},
+		{"NMIAfter", CPU.NMIAfter, 0},
+		{"NMIAfter", CPU.NMIAfter, 5},
+	} {
+		var (
+			cpu     = New(MOS6502, mem)
+			monitor = &handlerMonitor{entered: -1}
+		)
+		cpu.Registers().PC = 0x0600
+		cpu.Registers().P = U
+		cpu.Attach(monitor)
+		test.Do(cpu, test.N)
+		for i := 0; i < 10; i++ {
+			cpu.Step()
+		}
+		if monitor.entered != int64(test.N) {
+			t.Errorf("%s(%d): expected handler after %d instructions, got %d", test.Name, test.N, test.N, monitor.entered)
+		}
+	}
+
+	// Reset clears the request
+	cpu := New(MOS6502, mem)
+	cpu.IRQAfter(1)
+	cpu.Reset()
+	cpu.Registers().PC = 0x0600
+	cpu.Registers().P = U
+	for i := 0; i < 3; i++ {
+		cpu.Step()
+	}
+	if pc := cpu.Registers().PC; pc != 0x0603 {
+		t.Errorf("expected PC=$0603 after reset cleared IRQAfter, got $%04X", pc)
+	}
+}
+
+func TestStatusPushPull(t *testing.T) {
+	for _, test := range []struct {
+		Name string
+		Code uint8
+		Do   func(CPU)
+		P    uint8
+		Want uint8 // Value pushed
+	}{
+		{"PHP", 0x08, nil, N | C, N | U | B | C},
+		{"PHP", 0x08, nil, N | U | B | C, N | U | B | C},
+		{"BRK", 0x00, nil, N | C, N | U | B | C},
+		{"IRQ", 0xea, CPU.IRQ, N | C, N | U | C},
+		{"IRQ", 0xea, CPU.IRQ, N | U | B | C, N | U | C},
+		{"NMI", 0xea, CPU.NMI, N | C, N | U | C},
+		{"NMI", 0xea, CPU.NMI, N | U | B | C, N | U | C},
+	} {
+		cpu, mem := newTestCPU(MOS6502, []byte{test.Code})
+		cpu.Registers().P = test.P
+		if test.Do != nil {
+			test.Do(cpu)
+		}
+		cpu.Step()
+
+		// P is the last value pushed
+		addr := cpu.StackBase() | uint16(cpu.Registers().S+1)
+		if v := mem.Fetch(addr); v != test.Want {
+			t.Errorf("%s with P=%s: expected %s pushed, got %s", test.Name, fmtP(test.P), fmtP(test.Want), fmtP(v))
+		}
+	}
+
+	for _, test := range []struct {
+		Name   string
+		Code   uint8
+		Pulled uint8
+		Want   uint8 // P after pull
+	}{
+		{"PLP", 0x28, 0xff, 0xff &^ B},
+		{"PLP", 0x28, 0x00, U},
+		{"RTI", 0x40, 0xff, 0xff &^ B},
+		{"RTI", 0x40, 0x00, U},
+	} {
+		cpu, mem := newTestCPU(MOS6502, []byte{test.Code})
+		cpu.Registers().S = 0xf0
+		mem.Store(0x01f1, test.Pulled)
+		mem.Store(0x01f2, 0x00) // RTI return address
+		mem.Store(0x01f3, 0x06)
+		cpu.Step()
+
+		if v := cpu.Registers().P; v != test.Want {
+			t.Errorf("%s of %s: expected P=%s, got %s", test.Name, fmtP(test.Pulled), fmtP(test.Want), fmtP(v))
+		}
+	}
+}
+
+func TestHaltReason(t *testing.T) {
+	cpu, _ := newTestCPU(MOS6502, []byte{
+		0xea, // NOP
+		0x02, // KIL
+	})
+
+	if v := cpu.HaltReason(); v != NotHalted {
+		t.Fatalf("expected %s, got %s", NotHalted, v)
+	}
+	cpu.Run()
+	if v := cpu.HaltReason(); v != HaltInstruction {
+		t.Fatalf("expected %s, got %s", HaltInstruction, v)
+	}
+	if v := cpu.Registers().PC; v != 0x0601 {
+		t.Fatalf("expected PC=$0601, got $%04X", v)
+	}
+
+	// Malformed opcode table entry
+	defer func(op opcode) { opcodes[0x02] = op }(opcodes[0x02])
+	opcodes[0x02] = opcode{NOP, 1, 2, 0, AddressMode(0xff)}
+	cpu.Reset()
+	cpu.Registers().PC = 0x0601
+	cpu.Step()
+	if v := cpu.HaltReason(); v != HaltIllegalAddressMode {
+		t.Fatalf("expected %s, got %s", HaltIllegalAddressMode, v)
+	}
+	if v := cpu.Registers().PC; v != 0x0601 {
+		t.Fatalf("expected PC=$0601, got $%04X", v)
+	}
+}
+
+func TestOnHalt(t *testing.T) {
+	cpu, _ := newTestCPU(MOS6502, []byte{
+		0xea, // NOP
+		0x02, // KIL
+	})
+
+	var (
+		calls  int
+		reason HaltReason
+		pc     uint16
+	)
+	cpu.OnHalt(func(r HaltReason, addr uint16) {
+		calls++
+		reason, pc = r, addr
+	})
+	cpu.Run()
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+	if reason != HaltInstruction || pc != 0x0601 {
+		t.Fatalf("expected %s at $0601, got %s at $%04X", HaltInstruction, reason, pc)
+	}
+
+	// Removing the callback
+	cpu.OnHalt(nil)
+	cpu.ResetKeepPC()
+	cpu.Step()
+	if calls != 1 {
+		t.Fatalf("expected no call after removing the callback, got %d", calls)
+	}
+}
+
+func TestNOPCycles(t *testing.T) {
+	for _, test := range []struct {
+		Code   []byte
+		Cycles int
+	}{
+		{[]byte{0xea}, 2},             // NOP
+		{[]byte{0x80, 0xff}, 2},       // NOP #$FF
+		{[]byte{0x04, 0xff}, 3},       // NOP $FF
+		{[]byte{0x14, 0xff}, 4},       // NOP $FF,X
+		{[]byte{0x0c, 0xff, 0x12}, 4}, // NOP $12FF
+		{[]byte{0x1c, 0x00, 0x12}, 4}, // NOP $1200,X
+		{[]byte{0x1c, 0xff, 0x12}, 5}, // NOP $12FF,X (page cross)
+		{[]byte{0x3c, 0xff, 0x12}, 5},
+		{[]byte{0x5c, 0xff, 0x12}, 5},
+		{[]byte{0x7c, 0xff, 0x12}, 5},
+		{[]byte{0xdc, 0xff, 0x12}, 5},
+		{[]byte{0xfc, 0xff, 0x12}, 5},
+	} {
+		cpu, _ := newTestCPU(MOS6502, test.Code)
+		cpu.Registers().X = 0x01
+
+		if v := cpu.Step(); v != test.Cycles {
+			t.Errorf("% X: expected %d cycles, got %d", test.Code, test.Cycles, v)
+		}
+		if v := cpu.Registers().PC; v != 0x0600+uint16(len(test.Code)) {
+			t.Errorf("% X: expected PC=$%04X, got $%04X", test.Code, 0x0600+len(test.Code), v)
+		}
+	}
+}
+
+func TestStrictLegal(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		model := MOS6502
+		model.StrictLegal = strict
+		cpu, _ := newTestCPU(model, []byte{
+			0xa9, 0x42, // LDA #$42
+			0xa7, 0x10, // LAX $10
+		})
+		for i := 0; i < 3; i++ {
+			cpu.Step()
+		}
+
+		if !strict {
+			if cpu.Halted() {
+				t.Fatalf("expected CPU to run, halted with %s", cpu.HaltReason())
+			}
+			continue
+		}
+		if v := cpu.HaltReason(); v != HaltIllegalOpcode {
+			t.Fatalf("expected %s, got %s", HaltIllegalOpcode, v)
+		}
+		if pc, op := cpu.HaltedAt(); pc != 0x0602 || op != 0xa7 {
+			t.Fatalf("expected halt at $0602 on $A7, got $%04X on $%02X", pc, op)
+		}
+	}
+}
+
+func TestAccesses(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6502, []byte{
+		0xb1, 0x10, // LDA ($10),Y
+		0xe6, 0x12, // INC $12
+	})
+	(*mem)[0x10] = 0x00
+	(*mem)[0x11] = 0x12
+	(*mem)[0x12] = 0x41
+	(*mem)[0x1201] = 0x42
+	cpu.Registers().Y = 0x01
+	cpu.Attach(InstructionPrinter(func(string) {})) // Monitor reads are not accesses
+
+	for _, want := range [][]BusAccess{
+		{
+			{0x0600, 0xb1, false},
+			{0x0601, 0x10, false},
+			{0x0010, 0x00, false},
+			{0x0011, 0x12, false},
+			{0x1201, 0x42, false},
+		},
+		{
+			{0x0602, 0xe6, false},
+			{0x0603, 0x12, false},
+			{0x0012, 0x41, false},
+			{0x0012, 0x42, true},
+		},
+	} {
+		cpu.Step()
+		got := cpu.Accesses()
+		if len(got) != len(want) {
+			t.Fatalf("expected accesses %v, got %v", want, got)
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("expected accesses %v, got %v", want, got)
+			}
+		}
+	}
+
+	// The write of INC is the last access
+	if v := cpu.AddressBusValue(); v != 0x0012 {
+		t.Fatalf("expected address bus $0012, got $%04X", v)
+	}
+	if v := cpu.DataBusValue(); v != 0x42 {
+		t.Fatalf("expected data bus $42, got $%02X", v)
+	}
+}
+
+func TestSetReset(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	StoreWord(mem, ResetVector, 0x0600)
+	cpu := New(MOS6502, mem)
+	cpu.Registers().PC = 0x1000
+	cpu.Registers().A = 0x42
+
+	cpu.SetReset(true)
+	if v := cpu.Step(); v != 0 {
+		t.Fatalf("expected no cycles while in reset, got %d", v)
+	}
+	if v := cpu.Registers().PC; v != 0x1000 {
+		t.Fatalf("expected PC to stay at $1000 while in reset, got $%04X", v)
+	}
+
+	cpu.SetReset(false)
+	if v := cpu.Registers().PC; v != 0x0600 {
+		t.Fatalf("expected PC=$0600 after reset, got $%04X", v)
+	}
+	if v := cpu.Step(); v != 2 {
+		t.Fatalf("expected 2 cycles after reset, got %d", v)
+	}
+
+	// Releasing without asserting is a no-op
+	cpu.SetReset(false)
+	if v := cpu.Registers().PC; v != 0x0601 {
+		t.Fatalf("expected PC=$0601, got $%04X", v)
+	}
+}
+
+func TestResetKeepPC(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6502, []byte{
+		0xea, // NOP
+		0x02, // KIL
+	})
+	StoreWord(mem, ResetVector, 0x0400)
+	cpu.Run()
+
+	cpu.Registers().PC = 0x0700
+	cpu.ResetKeepPC()
+	if cpu.Halted() {
+		t.Fatal("expected CPU not to be halted after ResetKeepPC")
+	}
+	if r := cpu.Registers(); r.PC != 0x0700 || r.S != 0xfd {
+		t.Fatalf("expected PC=$0700 S=$FD, got %s", r)
+	}
+
+	cpu.Reset()
+	if v := cpu.Registers().PC; v != 0x0400 {
+		t.Fatalf("expected PC=$0400 after Reset, got $%04X", v)
+	}
+}
+
+func TestBRKReturnAddress(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6502, []byte{
+		0x00, 0xff, // BRK with signature byte
+	})
+	mem.Store(0x0700, 0x40) // RTI
+	StoreWord(mem, IRQVector, 0x0700)
+
+	if v := cpu.Step(); v != 7 {
+		t.Fatalf("expected 7 cycles, got %d", v)
+	}
+	s := cpu.Registers().S
+	if v := FetchWord(mem, cpu.StackBase()|uint16(s+2)); v != 0x0602 {
+		t.Fatalf("expected return address $0602 pushed, got $%04X", v)
+	}
+	cpu.Step()
+	if v := cpu.Registers().PC; v != 0x0602 {
+		t.Fatalf("expected RTI to return to $0602, got $%04X", v)
+	}
+}
+
+func TestZeroPageWrap(t *testing.T) {
+	for _, test := range []struct {
+		Code []byte
+		X, Y uint8
+		Want uint8
+	}{
+		{[]byte{0xa1, 0xff}, 0x00, 0x00, 0x11}, // LDA ($FF,X): pointer at $FF/$00
+		{[]byte{0xa1, 0x80}, 0x7f, 0x00, 0x11}, // LDA ($80,X): pointer at $FF/$00
+		{[]byte{0xa1, 0x80}, 0x81, 0x00, 0x22}, // LDA ($80,X): base wraps to $01
+		{[]byte{0xb1, 0xff}, 0x00, 0x01, 0x33}, // LDA ($FF),Y: pointer at $FF/$00
+		{[]byte{0xb5, 0xff}, 0x02, 0x00, 0x44}, // LDA $FF,X: wraps to $01
+	} {
+		var (
+			cpu, mem = newTestCPU(MOS6502, test.Code)
+			addr     = new(addrMonitor)
+		)
+		(*mem)[0x00ff] = 0x00 // Pointer $FF/$00 → $1200
+		(*mem)[0x0000] = 0x12
+		(*mem)[0x0001] = 0x44 // Pointer $01/$02 → $1344
+		(*mem)[0x0002] = 0x13
+		(*mem)[0x0100] = 0xee // Pointer high byte when not wrapping
+		(*mem)[0x1200] = 0x11
+		(*mem)[0x1344] = 0x22
+		(*mem)[0x1201] = 0x33
+		cpu.Registers().X = test.X
+
+		cpu.Registers().Y = test.Y
+		cpu.Attach(addr)
+		cpu.Step()
+		if v := cpu.Registers().A; v != test.Want {
+			t.Errorf("% X with X=$%02X Y=$%02X: expected A=$%02X, got $%02X", test.Code, test.X, test.Y, test.Want, v)
+		}
+		if v := mem.Fetch(addr.addr); v != test.Want {
+			t.Errorf("% X with X=$%02X Y=$%02X: Addr() returned $%04X holding $%02X", test.Code, test.X, test.Y, addr.addr, v)
+		}
+	}
+}
+
+// addrMonitor records the operand address of the last instruction
+type addrMonitor struct {
+	addr uint16
+}
+
+func (m *addrMonitor) BeforeExecute(_ CPU, in Instruction) bool {
+	m.addr = in.Addr()
+	return true
+}
+
+func TestFetchWordZP(t *testing.T) {
+	mem := memory.New(0x10000)
+	(*mem)[0x00ff] = 0x34
+	(*mem)[0x0000] = 0x12
+	(*mem)[0x0100] = 0xee
+	if v := FetchWordZP(mem, 0xff); v != 0x1234 {
+		t.Fatalf("expected $1234, got $%04X", v)
+	}
+}
+
+func TestVectors(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	StoreWord(mem, 0xff00, 0x1000)         // NMI
+	StoreWord(mem, 0xff02, 0x2000)         // Reset
+	StoreWord(mem, 0xff04, 0x3000)         // IRQ
+	mem.Store(0x0600, 0x00)                // BRK
+
+	model := MOS6502
+	model.NMIVector = 0xff00
+	model.ResetVector = 0xff02
+	model.IRQVector = 0xff04
+	cpu := New(model, mem)
+	if v := cpu.Registers().PC; v != 0x2000 {
+		t.Fatalf("expected reset to $2000, got $%04X", v)
+	}
+
+	cpu.Registers().PC = 0x0600
+	cpu.Step()
+	if v := cpu.Registers().PC; v != 0x3000 {
+		t.Fatalf("expected BRK to $3000, got $%04X", v)
+	}
+
+	// BRK set I, clear it so the IRQ is not masked
+	cpu.Registers().PC = 0x0700
+	cpu.Registers().P = U
+	cpu.IRQ()
+	cpu.Step()
+	if v := cpu.Registers().PC; v != 0x3001 {
+		t.Fatalf("expected IRQ to $3000, got $%04X", v-1)
+	}
+
+	cpu.NMI()
+	cpu.Step()
+	if v := cpu.Registers().PC; v != 0x1001 {
+		t.Fatalf("expected NMI to $1000, got $%04X", v-1)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	cpu, _ := newTestCPU(MOS6502, []byte{
+		0xa9, 0x42, // LDA #$42
+		0xea, // NOP
+		0x02, // KIL
+	})
+
+	trace := cpu.Trace(8)
+	if len(trace) != 3 {
+		t.Fatalf("expected 3 instructions until halted, got %d", len(trace))
+	}
+	for i, want := range []struct {
+		PC     uint16
+		Cycles int64
+		Raw    []byte
+	}{
+		{0x0600, 0, []byte{0xa9, 0x42}},
+		{0x0602, 2, []byte{0xea}},
+		{0x0603, 4, []byte{0x02}},
+	} {
+		in := trace[i]
+		if in.Registers.PC != want.PC || in.Cycles != want.Cycles || !bytes.Equal(in.Raw, want.Raw) {
+			t.Fatalf("instruction %d: expected $%04X at %d cycles (% X), got $%04X at %d cycles (% X)", i,
+				want.PC, want.Cycles, want.Raw, in.Registers.PC, in.Cycles, in.Raw)
+		}
+	}
+
+	for _, n := range []int{0, -1} {
+		if trace := cpu.Trace(n); trace != nil {
+			t.Errorf("Trace(%d): expected nil, got %d instructions", n, len(trace))
+		}
+	}
+}
+
+func benchmarkFunctional(b *testing.B, mapped bool) {
+	bin, err := ioutil.ReadFile("testdata/6502_functional_tests/6502_functional_test.bin")
+	if err != nil {
+		b.Skip(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		var (
+			ram               = memory.New(0x10000)
+			mem memory.Memory = ram
+		)
+		copy((*ram)[0x0400:], bin)
+		if mapped {
+			m := memory.NewMapper()
+			m.Map(0x0000, 0xffff, ram)
+			mem = m
+		}
+
+		cpu := New(Ricoh2A03, mem)
+		cpu.Registers().PC = 0x0400
+		for cpu.Cycles() < 1000000 {
+			cpu.Step()
+		}
+	}
+}
+
+// BenchmarkFunctionalRAM runs the functional test on 64kB RAM, which uses the
+// fast path
+func BenchmarkFunctionalRAM(b *testing.B) { benchmarkFunctional(b, false) }
+
+// BenchmarkFunctionalMapper runs the functional test on a Mapper
+func BenchmarkFunctionalMapper(b *testing.B) { benchmarkFunctional(b, true) }
+
+type dispatch struct {
+	Mnemonic
+	AddressMode
+	Addr uint16
+}
+
+type dispatchMonitor []dispatch
+
+func (m *dispatchMonitor) BeforeExecute(cpu CPU, in Instruction) bool {
+	*m = append(*m, dispatch{in.Mnemonic, in.AddressMode, in.Addr()})
+	return true
+}
+
+// executeSwitch dispatches using a switch instead of the ops table
+func (cpu *fast) executeSwitch(m Mnemonic, addr uint16) {
+	switch m {
+	case ADC:
+		cpu.adc(addr)
+	case AND:
+		cpu.and(addr)
+	case ASL:
+		cpu.asl(addr)
+	case BCC:
+		cpu.bcc(addr)
+	case BCS:
+		cpu.bcs(addr)
+	case BEQ:
+		cpu.beq(addr)
+	case BIT:
+		cpu.bit(addr)
+	case BMI:
+		cpu.bmi(addr)
+	case BNE:
+		cpu.bne(addr)
+	case BPL:
+		cpu.bpl(addr)
+	case BRK:
+		cpu.brk(addr)
+	case BVC:
+		cpu.bvc(addr)
+	case BVS:
+		cpu.bvs(addr)
+	case CLC:
+		cpu.clc(addr)
+	case CLD:
+		cpu.cld(addr)
+	case CLI:
+		cpu.cli(addr)
+	case CLV:
+		cpu.clv(addr)
+	case CMP:
+		cpu.cmp(addr)
+	case CPX:
+		cpu.cpx(addr)
+	case CPY:
+		cpu.cpy(addr)
+	case DEC:
+		cpu.dec(addr)
+	case DEX:
+		cpu.dex(addr)
+	case DEY:
+		cpu.dey(addr)
+	case EOR:
+		cpu.eor(addr)
+	case INC:
+		cpu.inc(addr)
+	case INX:
+		cpu.inx(addr)
+	case INY:
+		cpu.iny(addr)
+	case JMP:
+		cpu.jmp(addr)
+	case JSR:
+		cpu.jsr(addr)
+	case LDA:
+		cpu.lda(addr)
+	case LDX:
+		cpu.ldx(addr)
+	case LDY:
+		cpu.ldy(addr)
+	case LSR:
+		cpu.lsr(addr)
+	case NOP:
+		cpu.nop(addr)
+	case ORA:
+		cpu.ora(addr)
+	case PHA:
+		cpu.pha(addr)
+	case PHP:
+		cpu.php(addr)
+	case PLA:
+		cpu.pla(addr)
+	case PLP:
+		cpu.plp(addr)
+	case ROL:
+		cpu.rol(addr)
+	case ROR:
+		cpu.ror(addr)
+	case RTI:
+		cpu.rti(addr)
+	case RTS:
+		cpu.rts(addr)
+	case SBC:
+		cpu.sbc(addr)
+	case SEC:
+		cpu.sec(addr)
+	case SED:
+		cpu.sed(addr)
+	case SEI:
+		cpu.sei(addr)
+	case STA:
+		cpu.sta(addr)
+	case STX:
+		cpu.stx(addr)
+	case STY:
+		cpu.sty(addr)
+	case TAX:
+		cpu.tax(addr)
+	case TAY:
+		cpu.tay(addr)
+	case TSX:
+		cpu.tsx(addr)
+	case TXA:
+		cpu.txa(addr)
+	case TXS:
+		cpu.txs(addr)
+	case TYA:
+		cpu.tya(addr)
+	case HLT:
+		cpu.hlt(addr)
+	case LAX:
+		cpu.lax(addr)
+	case SAX:
+		cpu.sax(addr)
+	case DCP:
+		cpu.dcp(addr)
+	case ISC:
+		cpu.isc(addr)
+	case RLA:
+		cpu.rla(addr)
+	case RRA:
+		cpu.rra(addr)
+	case SLO:
+		cpu.slo(addr)
+	case SRE:
+		cpu.sre(addr)
+	case ANC:
+		cpu.anc(addr)
+	case ALR:
+		cpu.alr(addr)
+	case ARR:
+		cpu.arr(addr)
+	case XAA:
+		cpu.xaa(addr)
+	case AHX:
+		cpu.ahx(addr)
+	case TAS:
+		cpu.tas(addr)
+	case SHX:
+		cpu.shx(addr)
+	case SHY:
+		cpu.shy(addr)
+	case LAS:
+		cpu.las(addr)
+	case AXS:
+		cpu.axs(addr)
+	}
+}
+
+// BenchmarkDispatch compares dispatching operations through the ops table with
+// a switch, replaying the operations of the functional test
+func BenchmarkDispatch(b *testing.B) {
+	bin, err := ioutil.ReadFile("testdata/6502_functional_tests/6502_functional_test.bin")
+	if err != nil {
+		b.Skip(err)
+	}
+
+	var (
+		mem   = memory.New(0x10000)
+		trace = new(dispatchMonitor)
+	)
+	copy((*mem)[0x0400:], bin)
+	cpu := New(Ricoh2A03, mem).(*fast)
+	cpu.Registers().PC = 0x0400
+	cpu.Attach(trace)
+	for i := 0; i < 100000; i++ {
+		cpu.Step()
+	}
+	cpu.Attach(nil)
+
+	b.Run("table", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, op := range *trace {
+				cpu.addressMode = op.AddressMode
+				cpu.ops[op.Mnemonic](op.Addr)
+			}
+		}
+	})
+	b.Run("switch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, op := range *trace {
+				cpu.addressMode = op.AddressMode
+				cpu.executeSwitch(op.Mnemonic, op.Addr)
+			}
+		}
+	})
+}
+
+func TestStepMonitorAllocs(t *testing.T) {
+	cpu, _ := newTestCPU(MOS6502, nil)
+	cpu.Attach(new(Ring))
+	if n := testing.AllocsPerRun(100, func() { cpu.Step() }); n != 0 {
+		t.Fatalf("expected no allocations per step, got %.1f", n)
+	}
+}
+
+func BenchmarkStepMonitor(b *testing.B) {
+	cpu, _ := newTestCPU(MOS6502, nil)
+	cpu.Attach(new(Ring))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		cpu.Step()
+	}
+}
+
+func TestInterruptPending(t *testing.T) {
+	cpu, _ := newTestCPU(MOS6502, nil)
+	cpu.Registers().P = U
+	if v := cpu.InterruptPending(); v != None {
+		t.Fatalf("expected no pending interrupt, got %d", v)
+	}
+	if cpu.InterruptsMasked() {
+		t.Fatal("expected interrupts not to be masked")
+	}
+
+	cpu.IRQ()
+	if v := cpu.InterruptPending(); v != IRQ {
+		t.Fatalf("expected IRQ pending, got %d", v)
+	}
+	cpu.Step()
+	if v := cpu.InterruptPending(); v != None {
+		t.Fatalf("expected no pending interrupt after Step, got %d", v)
+	}
+	if !cpu.InterruptsMasked() {
+		t.Fatal("expected interrupts to be masked after IRQ")
+	}
+}
+
+func TestPollInterrupts(t *testing.T) {
+	// Derived from the CLI latency case of cpu_interrupts_v2: an IRQ pending
+	// while CLI executes is only taken after the next instruction.
+	model := MOS6502
+	model.PollInterrupts = true
+	cpu, mem := newTestCPU(model, []byte{
+		0x58, // CLI
+		0xea, // NOP
+		0xea, // NOP
+		0x78, // SEI
+		0xea, // NOP
+	})
+	mem.Store(0xfffe, 0x00)
+	mem.Store(0xffff, 0x30)
+
+	cpu.IRQ()
+	cpu.Step() // CLI
+	cpu.Step() // NOP, IRQ masked at the polling point of CLI
+	if v := cpu.Registers().PC; v != 0x0602 {
+		t.Fatalf("expected IRQ to be delayed after CLI, PC is $%04X", v)
+	}
+	cpu.Step() // IRQ, NOP at $3000
+	if v := cpu.Registers().PC; v != 0x3001 {
+		t.Fatalf("expected IRQ to be taken, PC is $%04X", v)
+	}
+	if v := FetchWord(cpu, 0x01fc); v != 0x0602 {
+		t.Fatalf("expected return address $0602, got $%04X", v)
+	}
+
+	// SEI is delayed as well, an IRQ right after it is still taken
+	cpu.Registers().PC = 0x0602
+	cpu.Registers().P &^= I
+	cpu.Step() // NOP
+	cpu.Step() // SEI
+	cpu.IRQ()
+	cpu.Step() // IRQ
+	if v := cpu.Registers().PC; v != 0x3001 {
+		t.Fatalf("expected IRQ to be taken after SEI, PC is $%04X", v)
+	}
+
+	// With I set, the IRQ stays pending
+	cpu.IRQ()
+	cpu.Step()
+	if v := cpu.InterruptPending(); v != IRQ {
+		t.Fatalf("expected IRQ to stay pending while masked, got %d", v)
+	}
+}
+
+func TestNextInstruction(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6502, []byte{
+		0xb1, 0x10, // LDA ($10),Y
+	})
+	StoreWord(mem, 0x0010, 0x1200)
+	cpu.Registers().Y = 0x04
+	before := *cpu.Registers()
+
+	in := cpu.NextInstruction()
+	if in.Mnemonic != LDA || in.AddressMode != IndirectIndexed {
+		t.Fatalf("expected LDA (%s), got %s (%s)", IndirectIndexed, in.Mnemonic, in.AddressMode)
+	}
+	if v := in.Addr(); v != 0x1204 {
+		t.Fatalf("expected address $1204, got $%04X", v)
+	}
+	if v := in.Operand(); v != "($10),Y" {
+		t.Fatalf("expected operand %q, got %q", "($10),Y", v)
+	}
+	if v := *cpu.Registers(); v != before {
+		t.Fatalf("expected registers %+v, got %+v", before, v)
+	}
+	if v := cpu.Cycles(); v != 0 {
+		t.Fatalf("expected no cycles, got %d", v)
+	}
+}
+
+func TestALRARR(t *testing.T) {
+	for _, test := range []struct {
+		Code  []byte
+		A     uint8
+		Carry bool
+		Want  uint8
+		P     uint8 // N, V, Z and C
+	}{
+		{[]byte{0x4b, 0x01}, 0x03, false, 0x00, Z | C}, // ALR #$01
+		{[]byte{0x4b, 0xfe}, 0xff, true, 0x7f, 0},      // ALR #$FE
+		{[]byte{0x6b, 0xff}, 0xff, true, 0xff, N | C},  // ARR #$FF
+		{[]byte{0x6b, 0xc0}, 0xff, false, 0x60, C},     // ARR #$C0
+		{[]byte{0x6b, 0xff}, 0x40, false, 0x20, V},     // ARR #$FF
+		{[]byte{0x6b, 0xff}, 0x80, false, 0x40, V | C}, // ARR #$FF
+		{[]byte{0x6b, 0x01}, 0x01, false, 0x00, Z},     // ARR #$01
+	} {
+		cpu, _ := newTestCPU(MOS6502, test.Code)
+		cpu.Registers().A = test.A
+		cpu.Registers().P = setFlag(U, C, test.Carry)
+		cpu.Step()
+
+		if v, p := cpu.Registers().A, cpu.Registers().P&(N|V|Z|C); v != test.Want || p != test.P {
+			t.Errorf("% X with A=$%02X: expected A=$%02X (%s), got $%02X (%s)",
+				test.Code, test.A, test.Want, fmtP(test.P), v, fmtP(p))
+		}
+	}
+}
+
+func TestSupportsBCD(t *testing.T) {
+	for _, test := range []struct {
+		Model Model
+		BCD   bool
+		A     uint8 // $09 + $01
+	}{
+		{MOS6502, true, 0x10},
+		{Ricoh2A03, false, 0x0a},
+	} {
+		cpu, _ := newTestCPU(test.Model, []byte{
+			0xf8,       // SED
+			0x18,       // CLC
+			0xa9, 0x09, // LDA #$09
+			0x69, 0x01, // ADC #$01
+		})
+		if v := cpu.SupportsBCD(); v != test.BCD {
+			t.Errorf("%s: expected SupportsBCD %t, got %t", test.Model.Name, test.BCD, v)
+		}
+		for i := 0; i < 4; i++ {
+			cpu.Step()
+		}
+		if !cpu.Registers().Decimal() {
+			t.Errorf("%s: expected SED to set D", test.Model.Name)
+		}
+		if v := cpu.Registers().A; v != test.A {
+			t.Errorf("%s: expected A=$%02X, got $%02X", test.Model.Name, test.A, v)
+		}
+	}
+}
+
+func TestIOPort(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6510, []byte{
+		0xa9, 0x0f, // LDA #$0F
+		0x85, 0x00, // STA $00
+		0xa9, 0x35, // LDA #$35
+		0x85, 0x01, // STA $01
+		0xa5, 0x01, // LDA $01
+		0xa6, 0x00, // LDX $00
+	})
+
+	cpu.SetPortInput(0xa0)
+	for i := 0; i < 6; i++ {
+		cpu.Step()
+	}
+	if v := cpu.Registers().A; v != 0xa5 {
+		t.Errorf("expected A=$A5, got $%02X", v)
+	}
+	if v := cpu.Registers().X; v != 0x0f {
+		t.Errorf("expected X=$0F, got $%02X", v)
+	}
+	if v := cpu.PortOutput(); v != 0xa5 {
+		t.Errorf("expected port output $A5, got $%02X", v)
+	}
+	if v := (*mem)[0x0001]; v != 0x35 {
+		t.Errorf("expected store to pass through to memory, got $%02X", v)
+	}
+
+	cpu.Reset()
+	if v := cpu.PortOutput(); v != 0xff {
+		t.Errorf("expected pulled up port after reset, got $%02X", v)
+	}
+
+	// Without an I/O port, $0000 and $0001 are plain memory
+	cpu = New(MOS6502, mem)
+	if v := cpu.Fetch(0x0001); v != 0x35 {
+		t.Errorf("expected memory at $0001, got $%02X", v)
+	}
+	if v := cpu.PortOutput(); v != 0x00 {
+		t.Errorf("expected no port output, got $%02X", v)
+	}
+}
+
+func TestARRDecimal(t *testing.T) {
+	for _, test := range []struct {
+		Model Model
+		A     uint8
+		Carry bool
+		Want  uint8
+		P     uint8 // N, V, Z and C
+	}{
+		{MOS6502, 0xff, false, 0xd5, C},
+		{MOS6502, 0x22, false, 0x11, 0},
+		{MOS6502, 0x05, true, 0x88, N},      // Low nibble adjusted
+		{MOS6502, 0x60, false, 0x90, V | C}, // N is based on the unadjusted result
+		{Ricoh2A03, 0x60, false, 0x30, V},   // No BCD support
+	} {
+		cpu, _ := newTestCPU(test.Model, []byte{0x6b, 0xff}) // ARR #$FF
+		cpu.Registers().A = test.A
+		cpu.Registers().P = setFlag(U|D, C, test.Carry)
+		cpu.Step()
+
+		if v, p := cpu.Registers().A, cpu.Registers().P&(N|V|Z|C); v != test.Want || p != test.P {
+			t.Errorf("%s: ARR #$FF with A=$%02X: expected A=$%02X (%s), got $%02X (%s)",
+				test.Model.Name, test.A, test.Want, fmtP(test.P), v, fmtP(p))
+		}
+	}
+}
+
+func TestOnTrap(t *testing.T) {
+	for _, test := range []struct {
+		Code []byte
+		P    uint8
+		Trap bool
+	}{
+		{[]byte{0x4c, 0x00, 0x06}, 0, true},  // JMP $0600
+		{[]byte{0x20, 0x00, 0x06}, 0, true},  // JSR $0600
+		{[]byte{0x6c, 0x10, 0x00}, 0, true},  // JMP ($0010)
+		{[]byte{0xd0, 0xfe}, 0, true},        // BNE *
+		{[]byte{0xd0, 0xfe}, Z, false},       // BNE * not taken
+		{[]byte{0x4c, 0x03, 0x06}, 0, false}, // JMP $0603
+	} {
+		cpu, mem := newTestCPU(MOS6502, test.Code)
+		StoreWord(mem, 0x0010, 0x0600)
+		cpu.Registers().P = U | test.P
+
+		var traps []uint16
+		cpu.OnTrap(func(pc uint16) { traps = append(traps, pc) })
+		cpu.Step()
+		if trapped := len(traps) > 0; trapped != test.Trap {
+			t.Errorf("% X with P=%s: expected trap %t, got %t", test.Code, fmtP(test.P), test.Trap, trapped)
+		} else if trapped && traps[0] != 0x0600 {
+			t.Errorf("% X: expected trap at $0600, got $%04X", test.Code, traps[0])
+		}
+	}
+}
+
+func TestStepOut(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6502, []byte{
+		0x20, 0x00, 0x07, // JSR $0700
+		0x02, // KIL
+	})
+	copy((*mem)[0x0700:], []byte{
+		0xea,             // NOP
+		0x20, 0x00, 0x08, // JSR $0800
+		0x60, // RTS
+	})
+	copy((*mem)[0x0800:], []byte{
+		0x60, // RTS
+	})
+	copy((*mem)[0x0900:], []byte{
+		0x4c, 0x00, 0x09, // JMP $0900
+	})
+	cpu.Step() // JSR $0700
+	cpu.Step() // NOP
+
+	// JSR, RTS, RTS
+	if v := cpu.StepOut(0); v != 6+6+6 {
+		t.Fatalf("expected 18 cycles, got %d", v)
+	}
+	if v := cpu.Registers().PC; v != 0x0603 {
+		t.Fatalf("expected PC=$0603, got $%04X", v)
+	}
+
+	// Never returns
+	cpu.Registers().PC = 0x0900
+	if v := cpu.StepOut(30); v != 30 {
+		t.Fatalf("expected to stop after 30 cycles, got %d", v)
+	}
+
+	// Halts
+	cpu.Registers().PC = 0x0603
+	cpu.StepOut(0)
+	if !cpu.Halted() {
+		t.Fatal("expected CPU to be halted")
+	}
+}
+
+// TestAccurateModel checks that the accuracy options of the Model only add
+// bus accesses, for documented instructions the registers, memory and cycle
+// totals are identical to the default model.
+func TestAccurateModel(t *testing.T) {
+	program := []byte{
+		0xa2, 0x10, // LDX #$10
+		0xa0, 0x00, // LDY #$00
+		0xbd, 0xf8, 0x06, // LDA $06F8,X
+		0x7d, 0x00, 0x07, // ADC $0700,X
+		0x99, 0x00, 0x08, // STA $0800,Y
+		0x1e, 0x00, 0x08, // ASL $0800,X
+		0xfe, 0xf8, 0x08, // INC $08F8,X
+		0x20, 0x30, 0x06, // JSR $0630
+		0xc8,       // INY
+		0xca,       // DEX
+		0xd0, 0xea, // BNE $0604
+		0x02, // KIL
+	}
+	subroutine := []byte{
+		0x48, // PHA
+		0x08, // PHP
+		0x58, // CLI
+		0x78, // SEI
+		0x28, // PLP
+		0x68, // PLA
+		0x60, // RTS
+	}
+
+	accurate := MOS6502
+	accurate.DummyReads = true
+	accurate.DummyWrites = true
+	accurate.PollInterrupts = true
+
+	var (
+		regs   [2]Registers
+		cycles [2]int
+		mems   [2]*memory.RAM
+	)
+	for i, model := range []Model{MOS6502, accurate} {
+		cpu, mem := newTestCPU(model, program)
+		for j := range (*mem)[0x0700:0x0800] {
+			(*mem)[0x0700+j] = uint8(j * 7)
+		}
+		copy((*mem)[0x0630:], subroutine)
+
+		var halted bool
+		if cycles[i], halted = cpu.RunUntilHalt(100000); !halted {
+			t.Fatalf("%+v: expected to halt", model)
+		}
+		regs[i], mems[i] = *cpu.Registers(), mem
+	}
+
+	if v := regs[0].Y; v != 0x10 {
+		t.Fatalf("expected 16 iterations, got %d", v)
+	}
+	if regs[0] != regs[1] {
+		t.Errorf("registers differ:\n%s\n%s", &regs[0], &regs[1])
+	}
+	if cycles[0] != cycles[1] {
+		t.Errorf("cycles differ: %d and %d", cycles[0], cycles[1])
+	}
+	for addr := range *mems[0] {
+		if a, b := (*mems[0])[addr], (*mems[1])[addr]; a != b {
+			t.Fatalf("memory differs at $%04X: $%02X and $%02X", addr, a, b)
+		}
+	}
+}
+
+func TestBusAccessCounters(t *testing.T) {
+	for _, test := range []struct {
+		Name          string
+		DummyWrites   bool
+		Reads, Writes int64
+	}{
+		// Opcode and operand fetches, INC reads $0200
+		{"default", false, 2 + 3 + 3 + 1 + 1, 1 + 1},
+		{"dummy writes", true, 2 + 3 + 3 + 1 + 1, 1 + 2},
+	} {
+		model := MOS6502
+		model.DummyWrites = test.DummyWrites
+		cpu, _ := newTestCPU(model, []byte{
+			0xa9, 0x01, // LDA #$01
+			0x8d, 0x00, 0x02, // STA $0200
+			0xee, 0x00, 0x02, // INC $0200
+			0xaa, // TAX
+		})
+		for i := 0; i < 4; i++ {
+
+			cpu.Step()
+		}
+		cpu.Fetch(0x0200) // Not executing, not counted
+		if v := cpu.BusReads(); v != test.Reads {
+			t.Errorf("%s: expected %d reads, got %d", test.Name, test.Reads, v)
+		}
+		if v := cpu.BusWrites(); v != test.Writes {
+			t.Errorf("%s: expected %d writes, got %d", test.Name, test.Writes, v)
+		}
+		cpu.ResetCycles()
+		if cpu.BusReads() != 0 || cpu.BusWrites() != 0 {
+			t.Errorf("%s: expected ResetCycles to zero the counters", test.Name)
+		}
+	}
+}
+
+func TestSetInternalRAM(t *testing.T) {
+	mem := memory.New(0x10000)
+	model := MOS6502
+	model.InternalMemory = 0x100
+	cpu := New(model, mem)
+	cpu.Store(0x0010, 0x42)
+
+	if err := cpu.SetInternalRAM(0x200); err == nil {
+		t.Fatal("expected an error while running")
+	}
+
+	cpu.SetReset(true)
+	if err := cpu.SetInternalRAM(0x300); err == nil {
+		t.Fatal("expected an error for a size that is not a power of two")
+	}
+
+	// Grow
+	if err := cpu.SetInternalRAM(0x200); err != nil {
+		t.Fatal(err)
+	}
+	cpu.Store(0x0180, 0x24)
+	if v := cpu.Fetch(0x0010); v != 0x42 {
+		t.Errorf("expected $0010 to be kept, got $%02X", v)
+	}
+	if v := (*mem)[0x0180]; v != 0x00 {
+		t.Errorf("expected $0180 in internal RAM, got $%02X on the bus", v)
+	}
+
+	// Shrink
+	if err := cpu.SetInternalRAM(0x80); err != nil {
+		t.Fatal(err)
+	}
+	if v := cpu.Fetch(0x0010); v != 0x42 {
+		t.Errorf("expected $0010 to be kept, got $%02X", v)
+	}
+	if v := cpu.Fetch(0x0180); v != 0x00 {
+		t.Errorf("expected $0180 from the bus, got $%02X", v)
+	}
+
+	// Remove
+	if err := cpu.SetInternalRAM(0); err != nil {
+		t.Fatal(err)
+	}
+	if v := cpu.Fetch(0x0010); v != 0x00 {
+		t.Errorf("expected $0010 from the bus, got $%02X", v)
+	}
+}
+
+func TestRunInReset(t *testing.T) {
+	cpu, _ := newTestCPU(MOS6502, nil)
+	cpu.SetReset(true)
+	if v := cpu.Run(); v != 0 {
+		t.Errorf("expected no cycles while held in reset, got %d", v)
+	}
+	if cpu.Halted() {
+		t.Error("expected the CPU not to be halted")
+	}
+}
+
+func TestRunUntilHalt(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6502, []byte{
+		0xea, // NOP
+		0x02, // KIL
+	})
+	copy((*mem)[0x0700:], []byte{
+		0x4c, 0x00, 0x07, // JMP $0700
+	})
+	copy((*mem)[0x0800:], []byte{
+		0xe8,       // INX
+		0xd0, 0xfd, // BNE $0800
+		0x4c, 0x00, 0x08, // JMP $0800
+	})
+
+	if v, halted := cpu.RunUntilHalt(0); !halted || v != 2 {
+		t.Errorf("expected to halt after 2 cycles, got %d (halted %t)", v, halted)
+	}
+
+	// Stuck in a self-loop
+	cpu.Registers().PC = 0x0700
+	if v, halted := cpu.RunUntilHalt(0); halted || v != 3 {
+		t.Errorf("expected to stop in the loop after 3 cycles, got %d (halted %t)", v, halted)
+	}
+
+	// Self-loop that an NMI will break, the handler halts
+	(*mem)[0xfffa], (*mem)[0xfffb] = 0x00, 0x06
+	cpu.NMIAfter(10)
+	if v, halted := cpu.RunUntilHalt(0); !halted || v <= 30 {
+		t.Errorf("expected to loop until the NMI, got %d (halted %t)", v, halted)
+	}
+
+	// Runs forever, capped
+	cpu.Registers().PC = 0x0800
+	if v, halted := cpu.RunUntilHalt(1000); halted || v < 1000 || v > 1010 {
+		t.Errorf("expected to stop after 1000 cycles, got %d (halted %t)", v, halted)
+	}
+}
+
+func TestInstructions(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6502, []byte{
+		0xea, 0xea, 0xea, 0xea, // NOP
+		0x02, // KIL
+	})
+	StoreWord(mem, IRQVector, 0x0600)
+
+	cpu.Step()
+	cpu.IRQ()
+	cpu.Step() // Interrupt sequence and NOP
+	if v := cpu.Instructions(); v != 2 {
+		t.Fatalf("expected 2 instructions, got %d", v)
+	}
+
+	cpu.Run() // 3 NOPs and KIL
+	if v := cpu.Instructions(); v != 6 {
+		t.Fatalf("expected 6 instructions, got %d", v)
+	}
+
+	cpu.ResetCycles()
+	if v := cpu.Instructions(); v != 0 {
+		t.Fatalf("expected no instructions after ResetCycles, got %d", v)
+	}
+}
+
+func TestCacheDecoding(t *testing.T) {
+	cpu, _ := newTestCPU(MOS6502, []byte{
+		0xa9, 0x01, // LDA #$01
+		0x8d, 0x01, 0x06, // STA $0601, patches the LDA operand
+		0xe8,       // INX
+		0xe0, 0x03, // CPX #$03
+		0xd0, 0xf6, // BNE $0600
+	})
+	cpu.CacheDecoding(0x0600, 0x06ff)
+	for i := 0; i < 3*5; i++ {
+		cpu.Step()
+	}
+
+	// The second LDA has to see the patched operand
+	if r := cpu.Registers(); r.A != 0x01 || r.X != 0x03 || r.PC != 0x060a {
+		t.Fatalf("expected A=$01 X=$03 PC=$060A, got A=$%02X X=$%02X PC=$%04X", r.A, r.X, r.PC)
+	}
+	if cpu.Cycles() != 3*(2+4+2+2)+2*3+2 {
+		t.Errorf("expected %d cycles, got %d", 3*(2+4+2+2)+2*3+2, cpu.Cycles())
+	}
+
+	// Patch the opcode from the CPU and check it is executed
+	cpu.Store(0x0600, 0xa2) // LDX #$01
+	cpu.Registers().PC = 0x0600
+	cpu.Step()
+	if r := cpu.Registers(); r.X != 0x01 {
+		t.Errorf("expected X=$01 after patching the opcode, got $%02X", r.X)
+	}
+}
+
+func TestCacheDecodingBanking(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6510, []byte{
+		0xa9, 0x01, // LDA #$01
+		0x85, 0x01, // STA $01
+	})
+	cpu.CacheDecoding(0x0600, 0x06ff)
+	cpu.CacheDecoding(0x0600, 0x06ff)
+	if n := len(cpu.(*fast).cache.regions); n != 1 {
+		t.Errorf("expected the region to be declared once, got %d", n)
+	}
+
+	cpu.Step()
+
+	if cpu.(*fast).cache.lookup(0x0600) == nil {
+		t.Fatal("expected LDA to be cached")
+	}
+	cpu.Step()
+	if cpu.(*fast).cache.lookup(0x0600) != nil {
+		t.Error("expected the store to the I/O port to flush the cache")
+	}
+
+	// Switch "banks" behind the CPU and flush by declaring the region again
+	cpu.Registers().PC = 0x0600
+	cpu.Step()
+	(*mem)[0x0600] = 0xa2 // LDX #$01
+	cpu.CacheDecoding(0x0600, 0x06ff)
+	cpu.Registers().PC = 0x0600
+	cpu.Step()
+	if v := cpu.Registers().X; v != 0x01 {
+		t.Errorf("expected X=$01 from the new bank, got $%02X", v)
+	}
+}
+
+func TestCacheDecodingBlargg(t *testing.T) {
+	if testing.Short() {
+		t.Skip("this test takes long to run")
+	}
+
+	for _, cached := range []bool{false, true} {
+		cpu, mem := runBlargg(t, "testdata/instr_test-v4/rom_singles/01-basics.bin", cached, 330200)
+		if (*mem)[0x6000] != 0x00 {
+			t.Errorf("cached=%t: expected result $00, got $%02X", cached, (*mem)[0x6000])
+		}
+		if cpu.Cycles() < 330200 {
+			t.Errorf("cached=%t: expected at least 330200 cycles, got %d", cached, cpu.Cycles())
+		}
+	}
+}
+
+func runBlargg(tb testing.TB, name string, cached bool, cycles int64) (CPU, *memory.RAM) {
+	bin, err := ioutil.ReadFile(name)
+	if err != nil {
+		tb.Skip(err)
+	}
+
+	mem := memory.New(0x10000)
+	copy((*mem)[0x8000:], bin)
+	(*mem)[0x6000] = 0xff
+
+	cpu := New(Ricoh2A03, mem)
+	if cached {
+		cpu.CacheDecoding(0x8000, 0xffff)
+	}
+	cpu.Registers().P = U | I
+	cpu.Registers().S = 0xff
+	for (*mem)[0x6000] != 0x00 && cpu.Cycles() < cycles+128 && !cpu.Halted() {
+		cpu.Step()
+	}
+	return cpu, mem
+}
+
+func benchmarkBlargg(b *testing.B, cached bool) {
+	for i := 0; i < b.N; i++ {
+		runBlargg(b, "testdata/instr_test-v4/rom_singles/01-basics.bin", cached, 330200)
+	}
+}
+
+// BenchmarkBlargg runs a Blargg test ROM
+func BenchmarkBlargg(b *testing.B) { benchmarkBlargg(b, false) }
+
+// BenchmarkBlarggCached runs a Blargg test ROM with decoding cached
+func BenchmarkBlarggCached(b *testing.B) { benchmarkBlargg(b, true) }
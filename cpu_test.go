@@ -145,6 +145,7 @@ func (test *testBinary) Run(t *testing.T) {
 	// PC
 	if test.PC > 0x0000 {
 		cpu.Registers().PC = test.PC
+		cpu.ResetKeepPC()
 	}
 	cpu.Registers().P = U | I
 	if test.S != 0x00 {
@@ -154,9 +155,9 @@ func (test *testBinary) Run(t *testing.T) {
 	}
 
 	// Run
-	cycles := 0
+	var cycles int64
 	for !(test.done || cpu.Halted()) {
-		cycles += cpu.Step()
+		cycles += int64(cpu.Step())
 	}
 
 	pass := test.Pass.Cond(test.last)
@@ -164,17 +165,16 @@ func (test *testBinary) Run(t *testing.T) {
 		t.Logf("stop reason....: %s", test.Stop.Reason())
 		t.Logf("final cycles...: %d", cycles)
 		t.Logf("final CPU state: %+v", cpu.Registers())
+		var (
+			zp    = cpu.ZeroPage()
+			stack = cpu.Stack()
+		)
 		t.Log("zero page......: $00-$0F")
-		t.Logf("0000 %s", padX((*mem)[:16]))
+		t.Logf("0000 %s", padX(zp[:16]))
 		t.Log("stack..........: $80-$FF")
-		t.Logf("0180 %s", padX((*mem)[0x0180:0x0190]))
-		t.Logf("0190 %s", padX((*mem)[0x0190:0x01a0]))
-		t.Logf("01a0 %s", padX((*mem)[0x01a0:0x01b0]))
-		t.Logf("01b0 %s", padX((*mem)[0x01b0:0x01c0]))
-		t.Logf("01c0 %s", padX((*mem)[0x01c0:0x01d0]))
-		t.Logf("01d0 %s", padX((*mem)[0x01d0:0x01e0]))
-		t.Logf("01e0 %s", padX((*mem)[0x01e0:0x01f0]))
-		t.Logf("01f0 %s", padX((*mem)[0x01f0:0x0200]))
+		for i := 0x80; i < 0x100; i += 0x10 {
+			t.Logf("%04x %s", cpu.StackBase()|uint16(i), padX(stack[i:i+0x10]))
+		}
 	}
 
 	if !pass {
@@ -448,6 +448,35 @@ func TestBranchPagecross(t *testing.T) {
 	test.Run(t)
 }
 
+func TestIndirectIndexedPagecross(t *testing.T) {
+	for _, patch := range []struct {
+		Y      uint8 // Second LDY operand
+		A      uint8
+		Cycles int64
+	}{
+		{0x10, 0xaa, 39}, // LDA ($10),Y crosses into page 3: 6 cycles
+		{0x0f, 0x55, 38}, // No page cross: 5 cycles
+	} {
+		test := &testBinary{
+			Model:  MOS6502,
+			Name:   "testdata/unit/indirect_indexed_pagecross_test.bin",
+			Offset: 0x0600,
+			PC:     0x0600,
+			Patch:  map[uint16]uint8{0x0618: patch.Y},
+			Stop: &conds{Any: true, Conds: []cond{
+				condOp(BRK),
+				condCycles{1000, math.MaxInt16},
+			}},
+			Pass: &conds{Conds: []cond{
+				condA(patch.A),
+				condX(0x55),
+				condCycles{patch.Cycles, patch.Cycles},
+			}},
+		}
+		test.Run(t)
+	}
+}
+
 func TestProcessorStatus(t *testing.T) {
 	test := &testBinary{
 		Model:  MOS6502,
@@ -529,6 +558,28 @@ func TestADD_SUB_BCD(t *testing.T) {
 	test.Run(t)
 }
 
+func TestFullBCD(t *testing.T) {
+	if testing.Short() {
+		t.Skip("this test takes long to run")
+	}
+
+	test := &testBinary{
+		Model:  MOS6502,
+		Name:   "testdata/unit/full_bcd_test.bin",
+		Offset: 0x0600,
+		PC:     0x0600,
+		Stop: &conds{Any: true, Conds: []cond{
+			condOp(BRK),
+			condCycles{70000000, math.MaxInt32},
+		}},
+		Pass: &conds{Conds: []cond{
+			condByte{0x0600, 0x00}, // ERROR
+			condCycles{61821255, 61821255},
+		}},
+	}
+	test.Run(t)
+}
+
 func Test_ADD_SUB_ProcessorStatus(t *testing.T) {
 	test := &testBinary{
 		Model:  MOS6502,
@@ -769,7 +820,7 @@ func TestNESTest(t *testing.T) {
 	test.Run(t)
 }
 
-func testBlargg(t *testing.T, name, value string, cycles int) {
+func testBlargg(t *testing.T, name, value string, cycles int64) {
 	if testing.Short() {
 		t.Skip("these tests take long to run")
 	}
@@ -954,3 +1005,52 @@ func TestTrapJSR(t *testing.T) {
 	}
 	test.Run(t)
 }
+
+func TestRegistersFlags(t *testing.T) {
+	for _, test := range []struct {
+		Flag uint8
+		Get  func(*Registers) bool
+		Set  func(*Registers, bool)
+	}{
+		{C, (*Registers).Carry, (*Registers).SetCarry},
+		{Z, (*Registers).Zero, (*Registers).SetZero},
+		{I, (*Registers).IRQDisabled, (*Registers).SetIRQDisabled},
+		{D, (*Registers).Decimal, (*Registers).SetDecimal},
+		{V, (*Registers).Overflow, (*Registers).SetOverflow},
+		{N, (*Registers).Negative, (*Registers).SetNegative},
+	} {
+		reg := &Registers{P: U}
+		test.Set(reg, true)
+		if reg.P != U|test.Flag || !test.Get(reg) {
+			t.Errorf("set %s: expected P=%s, got %s", fmtP(U|test.Flag), fmtP(U|test.Flag), fmtP(reg.P))
+		}
+		test.Set(reg, false)
+		if reg.P != U || test.Get(reg) {
+			t.Errorf("clear %s: expected P=%s, got %s", fmtP(test.Flag), fmtP(U), fmtP(reg.P))
+		}
+	}
+}
+
+func TestRegistersClone(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xe8) // INX
+	cpu := New(MOS6502, mem)
+	cpu.Registers().PC = 0x0600
+
+	before := cpu.Registers().Clone()
+	in, _ := cpu.StepInstruction()
+	after := cpu.Registers()
+	if before.X != 0x00 || before.PC != 0x0600 {
+		t.Errorf("expected the clone to keep X=$00 PC=$0600, got %s", &before)
+	}
+	if after.X != 0x01 || after.PC != 0x0601 {
+		t.Errorf("expected X=$01 PC=$0601, got %s", after)
+	}
+	if in.Registers != before {
+		t.Errorf("expected the instruction registers to be a snapshot %s, got %s", &before, &in.Registers)
+	}
+
+	after.A = 0x42
+	if before.A == 0x42 || in.Registers.A == 0x42 {
+		t.Error("expected the snapshots not to alias the live registers")
+	}
+}
@@ -0,0 +1,185 @@
+package mos65xx
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+// CodeMap marks memory as code or data for the disassembler. The zero value
+// marks all memory as code.
+type CodeMap struct {
+	data [0x10000 / 8]uint8
+}
+
+// Data marks the memory from start up to and including end as data. The end
+// is inclusive like DisassembleRange and memory.Mapper.Map, so a span can end
+// at $FFFF.
+func (m *CodeMap) Data(start, end uint16) {
+	for addr := int(start); addr <= int(end); addr++ {
+		m.data[addr>>3] |= 1 << uint(addr&7)
+	}
+}
+
+// Code marks the memory from start up to and including end as code. The end
+// is inclusive, like Data.
+func (m *CodeMap) Code(start, end uint16) {
+	for addr := int(start); addr <= int(end); addr++ {
+		m.data[addr>>3] &^= 1 << uint(addr&7)
+	}
+}
+
+// IsData returns true if addr is marked as data.
+func (m *CodeMap) IsData(addr uint16) bool {
+	return m != nil && m.data[addr>>3]&(1<<(addr&7)) != 0
+}
+
+// Disassembler decodes instructions from memory.
+type Disassembler struct {
+	memory.Memory
+
+	// Map marks data regions; if nil, all memory is decoded as code.
+	Map *CodeMap
+}
+
+// Disassemble decodes the instruction at addr. The returned Instruction is not
+// bound to a CPU, only PC is set in its Registers. Its Raw bytes are owned by
+// the caller. Operands past $FFFF are not read, the instruction is marked as
+// Truncated instead.
+func Disassemble(mem memory.Memory, addr uint16) Instruction {
+	return disassemble(mem, addr, make([]byte, 3))
+}
+
+// disassemble decodes the instruction at addr with raw as Raw buffer
+func disassemble(mem memory.Memory, addr uint16, raw []byte) Instruction {
+	var (
+		op        = opcodes[mem.Fetch(addr)]
+		size      = int(op.Size)
+		truncated = int(addr)+size > 0x10000
+	)
+	if truncated {
+		size = 0x10000 - int(addr)
+	}
+	raw = raw[:size:size]
+	for i := range raw {
+		raw[i] = mem.Fetch(addr + uint16(i))
+	}
+	return Instruction{
+		Mnemonic:        op.Mnemonic,
+		Registers:       Registers{PC: addr},
+		AddressMode:     op.Mode,
+		Size:            int(op.Size),
+		BaseCycles:      int(op.Cycles),
+		PageCrossCycles: int(op.PageCrossCycles),
+		Raw:             raw,
+		Truncated:       truncated,
+	}
+}
+
+// DisassembleRange decodes all instructions from start up to and including
+// end. An instruction starting before end is decoded in full, even if its
+// operand extends past end.
+func DisassembleRange(mem memory.Memory, start, end uint16) []Instruction {
+	return Disassembler{Memory: mem}.Range(start, end)
+}
+
+// Listing writes a conventional listing of the instructions from start up to
+// and including end, one instruction per line:
+//
+//	0600: A9 42     LDA #$42
+//
+// Undocumented opcodes are annotated with a trailing "; illegal" comment.
+func Listing(mem memory.Memory, start, end uint16, w io.Writer) error {
+	return Disassembler{Memory: mem}.Listing(start, end, w)
+}
+
+// Range decodes all instructions from start up to and including end, like
+// DisassembleRange. Data regions are skipped. The Raw bytes of the returned
+// instructions are copies, owned by the caller; they share one allocation.
+func (d Disassembler) Range(start, end uint16) []Instruction {
+	if end < start {
+		return nil
+	}
+	var (
+		out []Instruction
+		raw = make([]byte, 0, int(end)-int(start)+3)
+	)
+	d.walk(start, end, func(in Instruction) error {
+		n := len(raw)
+		raw = append(raw, in.Raw...)
+		in.Raw = raw[n:len(raw):len(raw)]
+		out = append(out, in)
+		return nil
+	}, nil)
+	return out
+}
+
+// Each calls fn for every instruction from start up to and including end,
+// without allocating. Data regions are skipped. Raw is only valid during the
+// call to fn and must be copied to be retained. Each stops at the first error
+// returned by fn.
+func (d Disassembler) Each(start, end uint16, fn func(Instruction) error) error {
+	return d.walk(start, end, fn, nil)
+}
+
+// Listing writes a listing like the Listing function; data regions are
+// rendered as .byte directives of up to three bytes per line.
+func (d Disassembler) Listing(start, end uint16, w io.Writer) error {
+	return d.walk(start, end, func(in Instruction) error {
+		_, err := io.WriteString(w, in.listing()+"\n")
+		return err
+	}, func(addr uint16, data []byte) error {
+		_, err := fmt.Fprintf(w, "%04X: %-8s  .byte %s\n", addr, padX(data), fmtBytes(data))
+		return err
+	})
+}
+
+// walk calls code for each decoded instruction and data for each run of data
+// bytes (if not nil); the bytes passed are reused for the next call
+func (d Disassembler) walk(start, end uint16, code func(Instruction) error, data func(uint16, []byte) error) error {
+	var buf [3]byte
+	for addr := int(start); addr <= int(end); {
+		if !d.Map.IsData(uint16(addr)) {
+			in := disassemble(d.Memory, uint16(addr), buf[:])
+			if err := code(in); err != nil {
+				return err
+			}
+			addr += len(in.Raw)
+			continue
+		}
+
+		b := buf[:0]
+		for len(b) < 3 && addr+len(b) <= int(end) && d.Map.IsData(uint16(addr+len(b))) {
+			b = append(b, d.Fetch(uint16(addr+len(b))))
+		}
+		if data != nil {
+			if err := data(uint16(addr), b); err != nil {
+				return err
+			}
+		}
+		addr += len(b)
+	}
+	return nil
+}
+
+// listing formats the instruction as a listing line
+func (in Instruction) listing() string {
+	s := strings.TrimRight(fmt.Sprintf("%04X: %-8s  %s %s", in.Registers.PC, padX(in.Raw), in.Mnemonic, in.Operand()), " ")
+	if !documented(in.Raw[0]) {
+		s += " ; illegal"
+	}
+	if in.Truncated {
+		s += " ; truncated"
+	}
+	return s
+}
+
+func fmtBytes(b []byte) string {
+	s := make([]string, len(b))
+	for i, c := range b {
+		s[i] = fmt.Sprintf("$%02X", c)
+	}
+	return strings.Join(s, ",")
+}
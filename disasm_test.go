@@ -0,0 +1,204 @@
+package mos65xx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+func TestDisassembleRange(t *testing.T) {
+	mem := memory.New(0x10000)
+	copy((*mem)[0x0600:], []byte{
+		0xa9, 0x42, // LDA #$42
+		0x8d, 0x00, 0x02, // STA $0200
+		0xea, // NOP
+	})
+
+	ins := DisassembleRange(mem, 0x0600, 0x0605)
+	if len(ins) != 3 {
+		t.Fatalf("expected 3 instructions, got %d", len(ins))
+	}
+	for i, want := range []struct {
+		PC       uint16
+		Mnemonic Mnemonic
+		Mode     AddressMode
+		Operand  string
+	}{
+		{0x0600, LDA, Immediate, "#$42"},
+		{0x0602, STA, Absolute, "$0200"},
+		{0x0605, NOP, Implied, ""},
+	} {
+		in := ins[i]
+		if in.Registers.PC != want.PC || in.Mnemonic != want.Mnemonic || in.AddressMode != want.Mode {
+			t.Fatalf("instruction %d: expected %04X %s (%s), got %04X %s (%s)", i,
+				want.PC, want.Mnemonic, want.Mode, in.Registers.PC, in.Mnemonic, in.AddressMode)
+		}
+		if v := in.Operand(); v != want.Operand {
+			t.Fatalf("instruction %d: expected operand %q, got %q", i, want.Operand, v)
+		}
+	}
+
+	if ins := DisassembleRange(mem, 0x0700, 0x0600); len(ins) != 0 {
+		t.Fatalf("expected no instructions for a reversed range, got %d", len(ins))
+	}
+}
+
+func TestListing(t *testing.T) {
+	mem := memory.New(0x10000)
+	copy((*mem)[0x0600:], []byte{
+		0xa9, 0x42, // LDA #$42
+		0x9d, 0x00, 0x02, // STA $0200,X
+		0xa7, 0x10, // LAX $10
+		0x6a, // ROR A
+		0x00, // BRK
+	})
+
+	var (
+		b    = new(bytes.Buffer)
+		want = "" +
+			"0600: A9 42     LDA #$42\n" +
+			"0602: 9D 00 02  STA $0200,X\n" +
+			"0605: A7 10     LAX $10 ; illegal\n" +
+			"0607: 6A        ROR A\n" +
+			"0608: 00        BRK\n"
+	)
+	if err := Listing(mem, 0x0600, 0x0608, b); err != nil {
+		t.Fatal(err)
+	}
+	if v := b.String(); v != want {
+		t.Fatalf("expected listing:\n%s\ngot:\n%s", want, v)
+	}
+}
+
+func TestListingIllegal(t *testing.T) {
+	mem := memory.New(0x10000)
+	copy((*mem)[0x0600:], []byte{
+		0x04, 0x44, // NOP $44
+		0x0c, 0x00, 0x02, // NOP $0200
+		0x80, 0x01, // NOP #$01
+		0x1a,       // NOP
+		0xc7, 0x10, // DCP $10
+		0xeb, 0x01, // SBC #$01
+		0xea, // NOP
+	})
+
+	var (
+		b    = new(bytes.Buffer)
+		want = "" +
+			"0600: 04 44     NOP $44 ; illegal\n" +
+			"0602: 0C 00 02  NOP $0200 ; illegal\n" +
+			"0605: 80 01     NOP #$01 ; illegal\n" +
+			"0607: 1A        NOP ; illegal\n" +
+			"0608: C7 10     DCP $10 ; illegal\n" +
+			"060A: EB 01     SBC #$01 ; illegal\n" +
+			"060C: EA        NOP\n"
+	)
+	if err := Listing(mem, 0x0600, 0x060c, b); err != nil {
+		t.Fatal(err)
+	}
+	if v := b.String(); v != want {
+		t.Fatalf("expected listing:\n%s\ngot:\n%s", want, v)
+	}
+}
+
+func TestDisassemblerCodeMap(t *testing.T) {
+	mem := memory.New(0x10000)
+	copy((*mem)[0x0600:], []byte{
+		0x4c, 0x08, 0x06, // JMP $0608
+		0x20, 0x60, 0xa9, 0x00, 0xff, // Data
+		0xa9, 0x42, // LDA #$42
+	})
+
+	var (
+		m = new(CodeMap)
+		d = Disassembler{Memory: mem, Map: m}
+	)
+	m.Data(0x0603, 0x0607)
+	if !m.IsData(0x0603) || !m.IsData(0x0607) || m.IsData(0x0608) {
+		t.Fatal("expected $0603-$0607 to be marked as data")
+	}
+
+	ins := d.Range(0x0600, 0x0609)
+	if len(ins) != 2 {
+		t.Fatalf("expected 2 instructions, got %d", len(ins))
+	}
+	if ins[1].Registers.PC != 0x0608 || ins[1].Mnemonic != LDA {
+		t.Fatalf("expected LDA at $0608, got %s at $%04X", ins[1].Mnemonic, ins[1].Registers.PC)
+	}
+
+	var (
+		b    = new(bytes.Buffer)
+		want = "" +
+			"0600: 4C 08 06  JMP $0608\n" +
+			"0603: 20 60 A9  .byte $20,$60,$A9\n" +
+			"0606: 00 FF     .byte $00,$FF\n" +
+			"0608: A9 42     LDA #$42\n"
+	)
+	if err := d.Listing(0x0600, 0x0609, b); err != nil {
+		t.Fatal(err)
+	}
+	if v := b.String(); v != want {
+		t.Fatalf("expected listing:\n%s\ngot:\n%s", want, v)
+	}
+
+	// Without a map, the data desyncs the following code
+	if ins := DisassembleRange(mem, 0x0600, 0x0609); ins[1].Mnemonic != JSR {
+		t.Fatalf("expected JSR without a code map, got %s", ins[1].Mnemonic)
+	}
+}
+
+func TestDisassemblerEach(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	copy((*mem)[0x0600:], []byte{
+		0xa9, 0x42, // LDA #$42
+		0x8d, 0x00, 0x02, // STA $0200
+	})
+
+	var (
+		d     = Disassembler{Memory: mem}
+		count int
+	)
+	allocs := testing.AllocsPerRun(10, func() {
+		count = 0
+		d.Each(0x0600, 0x06ff, func(in Instruction) error {
+			count++
+			return nil
+		})
+	})
+	if count != 0xfd {
+		t.Errorf("expected %d instructions, got %d", 0xfd, count)
+	}
+	if allocs > 1 {
+		t.Errorf("expected no allocation per instruction, got %.0f allocations", allocs)
+	}
+
+	// Range copies Raw
+	out := d.Range(0x0600, 0x0605)
+	if len(out) != 3 || padX(out[0].Raw) != "A9 42" || padX(out[1].Raw) != "8D 00 02" || padX(out[2].Raw) != "EA" {
+		t.Fatalf("expected LDA, STA and NOP, got %v", out)
+	}
+}
+
+func TestDisassembleTruncated(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	mem.Store(0xfffe, 0xa9)                // LDA #
+	mem.Store(0xffff, 0x4c)                // JMP
+
+	in := Disassemble(mem, 0xffff)
+	if !in.Truncated || in.Mnemonic != JMP || in.Size != 3 || len(in.Raw) != 1 {
+		t.Fatalf("expected truncated 3 byte JMP with 1 raw byte, got %s, truncated %t, %d raw bytes",
+			in.Mnemonic, in.Truncated, len(in.Raw))
+	}
+	if in = Disassemble(mem, 0xfffe); in.Truncated || len(in.Raw) != 2 {
+		t.Errorf("expected complete LDA, got truncated %t with %d raw bytes", in.Truncated, len(in.Raw))
+	}
+
+	var b bytes.Buffer
+	if err := Listing(mem, 0xffff, 0xffff, &b); err != nil {
+		t.Fatal(err)
+	}
+	if want := "FFFF: 4C        JMP $0000 ; truncated\n"; b.String() != want {
+		t.Errorf("expected listing:\n%s\ngot:\n%s", want, b.String())
+	}
+}
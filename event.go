@@ -0,0 +1,33 @@
+package mos65xx
+
+// Event is a handle to a callback scheduled with ScheduleAfter.
+type Event struct {
+	at int64
+	fn func()
+}
+
+// events is a queue of scheduled events, ordered by their target cycle
+type events []*Event
+
+// insert an event, keeping the queue ordered; events scheduled for the same
+// cycle fire in the order they were scheduled
+func (q events) insert(e *Event) events {
+	i := len(q)
+	for i > 0 && q[i-1].at > e.at {
+		i--
+	}
+	q = append(q, nil)
+	copy(q[i+1:], q[i:])
+	q[i] = e
+	return q
+}
+
+// remove an event, returns false if the event was not found
+func (q events) remove(e *Event) (events, bool) {
+	for i, o := range q {
+		if o == e {
+			return append(q[:i], q[i+1:]...), true
+		}
+	}
+	return q, false
+}
@@ -0,0 +1,77 @@
+package mos65xx
+
+import (
+	"testing"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+func TestScheduleAfter(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	StoreWord(mem, NMIVector, 0x0300)
+
+	var (
+		cpu    = New(MOS6502, mem)
+		fired  []int
+		cycles int
+	)
+	cpu.ScheduleAfter(5, func() { fired = append(fired, cycles) })
+	cpu.ScheduleAfter(3, func() { fired = append(fired, cycles) })
+	cancel := cpu.ScheduleAfter(4, func() { t.Fatal("cancelled event fired") })
+	cpu.ScheduleAfter(8, func() {
+		fired = append(fired, cycles)
+		cpu.NMI()
+	})
+
+	if !cpu.CancelScheduled(cancel) {
+		t.Fatal("expected cancel to succeed")
+	}
+	if cpu.CancelScheduled(cancel) {
+		t.Fatal("expected second cancel to fail")
+	}
+
+	for i := 0; i < 4; i++ {
+		cycles += 2
+		if n := cpu.Step(); n != 2 {
+			t.Fatalf("expected NOP to take 2 cycles, got %d", n)
+		}
+	}
+
+	// Events fire after the instruction that reaches the target cycle
+	want := []int{4, 6, 8}
+	if len(fired) != len(want) {
+		t.Fatalf("expected %d events to fire, got %d", len(want), len(fired))
+	}
+	for i, v := range want {
+		if fired[i] != v {
+			t.Fatalf("expected event %d to fire at cycle %d, got %d", i, v, fired[i])
+		}
+	}
+
+	// The NMI requested by the last event is handled by the next step
+	cpu.Step()
+	if pc := cpu.Registers().PC; pc != 0x0301 {
+		t.Fatalf("expected PC $0301, got $%04X", pc)
+	}
+}
+
+func TestScheduleAfterReschedule(t *testing.T) {
+	var (
+		cpu, _ = newTestCPU(MOS6502, nil)
+		fired  int
+		fn     func()
+	)
+	fn = func() {
+		fired++
+		cpu.ScheduleAfter(0, fn)
+	}
+	cpu.ScheduleAfter(0, fn)
+
+	// Rescheduling without delay runs once per step instead of looping
+	for i := 1; i <= 3; i++ {
+		cpu.Step()
+		if fired != i {
+			t.Fatalf("expected %d events after %d steps, got %d", i, i, fired)
+		}
+	}
+}
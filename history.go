@@ -0,0 +1,157 @@
+package mos65xx
+
+import "fmt"
+
+// History records undo information for the most recent steps of a CPU, for
+// stepping backwards in a debugger. Every Step stores the registers, counters
+// and interrupt state before the step, and the previous value of each byte
+// stored by the CPU during the step, including the stack pushes of interrupt
+// sequences.
+//
+// The history is bounded, only the last size steps can be undone. Side
+// effects outside of the CPU state and memory can not be undone: reads and
+// writes of memory mapped I/O are not reverted and scheduled events are not
+// restored. Reading the previous value of a store is a Fetch on the memory,
+// which may have side effects of its own for I/O.
+type History struct {
+	cpu     *fast
+	records []historyRecord
+	next    int // Next record to write
+	len     int
+}
+
+type historyRecord struct {
+	reg        Registers
+	cycles     int64
+	executed   int64
+	interrupt  Interrupt
+	pollI      uint8
+	irqAfter   int
+	nmiAfter   int
+	inReset    bool
+	crossed    bool
+	lastAccess BusAccess
+	halt       HaltReason
+	haltPC     uint16
+	haltOpcode uint8
+	portDDR    uint8
+	portData   uint8
+	portInput  uint8
+	stores     []historyStore
+}
+
+type historyStore struct {
+	addr  uint16
+	value uint8 // Value before the store
+}
+
+// RecordHistory starts recording the last size steps of cpu, it returns an
+// error if cpu is not created by New. It replaces a previously recorded
+// History.
+func RecordHistory(cpu CPU, size int) (*History, error) {
+	f, ok := cpu.(*fast)
+	if !ok {
+		return nil, fmt.Errorf("mos65xx: can not record the history of %T", cpu)
+	}
+	h := &History{
+		cpu:     f,
+		records: make([]historyRecord, size),
+	}
+	f.history = h
+	return h, nil
+}
+
+// Stop recording, the recorded steps can still be undone.
+func (h *History) Stop() {
+	if h.cpu.history == h {
+		h.cpu.history = nil
+	}
+}
+
+// Len is the number of steps that can be undone.
+func (h *History) Len() int { return h.len }
+
+// StepBack reverts the most recent recorded step, returns false if there is
+// none.
+func (h *History) StepBack() bool {
+	if h.len == 0 {
+		return false
+	}
+	if h.next--; h.next < 0 {
+		h.next = len(h.records) - 1
+	}
+	h.len--
+
+	var (
+		r   = &h.records[h.next]
+		cpu = h.cpu
+	)
+	// The port goes first, memory may depend on it (such as banking)
+	cpu.portDDR = r.portDDR
+	cpu.portData = r.portData
+	cpu.portInput = r.portInput
+	for i := len(r.stores) - 1; i >= 0; i-- {
+		cpu.pokeBus(r.stores[i].addr, r.stores[i].value)
+	}
+	*cpu.reg = r.reg
+	cpu.cycles = r.cycles
+	cpu.executed = r.executed
+	cpu.interrupt = r.interrupt
+	cpu.pollI = r.pollI
+	cpu.irqAfter = r.irqAfter
+	cpu.nmiAfter = r.nmiAfter
+	cpu.inReset = r.inReset
+	cpu.pageCrossed = r.crossed
+	cpu.lastAccess = r.lastAccess
+	cpu.halt = r.halt
+	cpu.haltPC = r.haltPC
+	cpu.haltOpcode = r.haltOpcode
+	return true
+}
+
+// begin a record for the next step
+func (h *History) begin() {
+	if len(h.records) == 0 {
+		return
+	}
+	cpu := h.cpu
+	r := &h.records[h.next]
+	*r = historyRecord{
+		reg:        *cpu.reg,
+		cycles:     cpu.cycles,
+		executed:   cpu.executed,
+		interrupt:  cpu.interrupt,
+		pollI:      cpu.pollI,
+		irqAfter:   cpu.irqAfter,
+		nmiAfter:   cpu.nmiAfter,
+		inReset:    cpu.inReset,
+		crossed:    cpu.pageCrossed,
+		lastAccess: cpu.lastAccess,
+		halt:       cpu.halt,
+		haltPC:     cpu.haltPC,
+		haltOpcode: cpu.haltOpcode,
+		portDDR:    cpu.portDDR,
+		portData:   cpu.portData,
+		portInput:  cpu.portInput,
+		stores:     r.stores[:0],
+	}
+	if h.next++; h.next == len(h.records) {
+		h.next = 0
+	}
+	if h.len < len(h.records) {
+		h.len++
+	}
+}
+
+// store records the value at addr before it is overwritten
+func (h *History) store(addr uint16) {
+	if h.len == 0 {
+		return
+	}
+	i := h.next - 1
+	if i < 0 {
+		i = len(h.records) - 1
+	}
+	r := &h.records[i]
+	r.stores = append(r.stores, historyStore{addr: addr, value: h.cpu.peekBus(addr)})
+}
@@ -0,0 +1,170 @@
+package mos65xx
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+func TestHistory(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6502, []byte{
+		0xa9, 0x42, // LDA #$42
+		0x8d, 0x00, 0x02, // STA $0200
+		0x48,             // PHA
+		0x20, 0x00, 0x07, // JSR $0700
+	})
+	copy((*mem)[0x0700:], []byte{
+		0xee, 0x00, 0x02, // INC $0200
+		0x60, // RTS
+	})
+	StoreWord(mem, IRQVector, 0x3000)
+
+	cpu.Registers().P = U
+
+	var (
+		before    = append(memory.RAM(nil), *mem...)
+		reg       = *cpu.Registers()
+		registers []Registers
+		cycles    []int64
+	)
+	history, err := RecordHistory(cpu, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		registers = append(registers, *cpu.Registers())
+		cycles = append(cycles, cpu.Cycles())
+		if i == 4 {
+			cpu.IRQ()
+		}
+		cpu.Step()
+	}
+	if history.Len() != 6 {
+		t.Fatalf("expected 6 steps of history, got %d", history.Len())
+	}
+
+	for i := 5; i >= 0; i-- {
+		if !history.StepBack() {
+			t.Fatalf("expected to step back step %d", i)
+		}
+		if r := *cpu.Registers(); r != registers[i] {
+			t.Errorf("step %d: expected %s, got %s", i, &registers[i], &r)
+		}
+		if c := cpu.Cycles(); c != cycles[i] {
+			t.Errorf("step %d: expected %d cycles, got %d", i, cycles[i], c)
+		}
+	}
+	if history.StepBack() {
+		t.Error("expected no more history")
+	}
+	if r := *cpu.Registers(); r != reg {
+		t.Errorf("expected %s, got %s", &reg, &r)
+	}
+	if !bytes.Equal(*mem, before) {
+		t.Error("expected memory to be restored")
+	}
+
+	// Replaying gives the same result
+	cpu.Step()
+	cpu.Step()
+	if v := mem.Fetch(0x0200); v != 0x42 {
+		t.Errorf("expected $42 at $0200 after replay, got $%02X", v)
+	}
+}
+
+func TestHistoryBounded(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xe8) // INX
+	cpu := New(MOS6502, mem)
+	cpu.Registers().PC = 0x0600
+
+	history, err := RecordHistory(cpu, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		cpu.Step()
+	}
+	history.Stop()
+	cpu.Step()
+
+	var n int
+	for history.StepBack() {
+		n++
+	}
+	if n != 4 {
+		t.Errorf("expected 4 steps back, got %d", n)
+	}
+	if x := cpu.Registers().X; x != 11-1-4 {
+		t.Errorf("expected X=%d, got %d", 11-1-4, x)
+	}
+}
+
+func TestHistoryIOPort(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6510, []byte{
+		0xa9, 0x0f, // LDA #$0F
+		0x85, 0x00, // STA $00
+		0xa9, 0x35, // LDA #$35
+		0x85, 0x01, // STA $01
+	})
+	(*mem)[0x0001] = 0x99
+
+	cpu.SetPortInput(0xa0)
+	cpu.Step() // LDA #$0F
+	cpu.Step() // STA $00
+	cpu.Step() // LDA #$35
+
+	history, err := RecordHistory(cpu, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.Step() // STA $01
+	if v := cpu.PortOutput(); v != 0xa5 {
+		t.Fatalf("expected port output $A5, got $%02X", v)
+	}
+
+	cpu.SetPortInput(0x50)
+	history.StepBack()
+	// Data $00 on the outputs, the input $A0 as it was before the step
+	if v := cpu.Fetch(0x0001); v != 0xa0 {
+		t.Errorf("expected port data $00 with input $A0 after stepping back, got $%02X", v)
+	}
+	if v := (*mem)[0x0001]; v != 0x99 {
+		t.Errorf("expected the RAM under $0001 to be restored to $99, got $%02X", v)
+	}
+}
+
+func TestHistoryIRQAfter(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6502, nil)
+	StoreWord(mem, IRQVector, 0x3000)
+	cpu.Registers().P = U
+	cpu.IRQAfter(2)
+
+	history, err := RecordHistory(cpu, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pcs []uint16
+	for i := 0; i < 4; i++ {
+		cpu.Step()
+		pcs = append(pcs, cpu.Registers().PC)
+	}
+	if pcs[2] != 0x3001 {
+		t.Fatalf("expected the IRQ before the third instruction, got PC=$%04X", pcs[2])
+	}
+
+	for history.StepBack() {
+	}
+	for i, want := range pcs {
+		cpu.Step()
+		if v := cpu.Registers().PC; v != want {
+			t.Errorf("replay step %d: expected PC=$%04X, got $%04X", i, want, v)
+		}
+	}
+}
+
+func TestRecordHistoryCPU(t *testing.T) {
+	if _, err := RecordHistory(struct{ CPU }{}, 4); err == nil {
+		t.Error("expected an error for a CPU not created by New")
+	}
+}
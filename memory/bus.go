@@ -40,3 +40,22 @@ func (bus ReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
 	}
 	return int(size), err
 }
+
+// Writer implements io.Writer on Memory, storing successive bytes from Addr
+// onwards. Addr advances with every byte written and wraps at $FFFF, so a
+// program can be loaded with:
+//
+//	io.Copy(&memory.Writer{Memory: mem, Addr: 0x0600}, f)
+type Writer struct {
+	Memory
+	Addr uint16
+}
+
+// Write stores p starting at Addr, it always writes all of p.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	for _, b := range p {
+		w.Store(w.Addr, b)
+		w.Addr++
+	}
+	return len(p), nil
+}
@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"bytes"
 	"io"
 	"testing"
 )
@@ -28,3 +29,32 @@ func TestReaderAt(t *testing.T) {
 		t.Fatalf("expected ErrShortBuffer; got %v", err)
 	}
 }
+
+func TestWriter(t *testing.T) {
+	mem := New(0x10000)
+	code := []byte{0xa9, 0x42, 0x00}
+
+	n, err := io.Copy(&Writer{Memory: mem, Addr: 0x0600}, bytes.NewReader(code))
+	if err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("expected to write 3 bytes, got %d", n)
+	}
+	if v := (*mem)[0x0600:0x0603]; !bytes.Equal(v, code) {
+		t.Fatalf("expected % X at $0600, got % X", code, v)
+	}
+
+	w := &Writer{Memory: mem, Addr: 0xffff}
+	if _, err := w.Write([]byte{0x01, 0x02}); err != nil {
+		t.Fatal(err)
+	}
+	if v := (*mem)[0xffff]; v != 0x01 {
+		t.Fatalf("expected $01 at $FFFF, got $%02X", v)
+	}
+	if v := (*mem)[0x0000]; v != 0x02 {
+		t.Fatalf("expected write to wrap to $0000, got $%02X", v)
+	}
+	if w.Addr != 0x0001 {
+		t.Fatalf("expected Addr $0001, got $%04X", w.Addr)
+	}
+}
@@ -0,0 +1,37 @@
+package memory
+
+import (
+	"crypto/sha256"
+	"hash/crc32"
+	"io"
+)
+
+// Checksum returns the CRC-32 (IEEE) of the memory from start up to and
+// including stop.
+func Checksum(m Memory, start, stop uint16) uint32 {
+	return crc32.ChecksumIEEE(readRange(m, start, stop))
+}
+
+// ChecksumSHA256 returns the SHA-256 of the memory from start up to and
+// including stop.
+func ChecksumSHA256(m Memory, start, stop uint16) [32]byte {
+	return sha256.Sum256(readRange(m, start, stop))
+}
+
+// readRange reads the memory from start up to and including stop, using
+// io.ReaderAt if the memory implements it
+func readRange(m Memory, start, stop uint16) []byte {
+	if stop < start {
+		return nil
+	}
+	b := make([]byte, int(stop)-int(start)+1)
+	if r, ok := m.(io.ReaderAt); ok {
+		if n, _ := r.ReadAt(b, int64(start)); n == len(b) {
+			return b
+		}
+	}
+	for i := range b {
+		b[i] = m.Fetch(start + uint16(i))
+	}
+	return b
+}
@@ -0,0 +1,28 @@
+package memory
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	mem := New(0x10000)
+	copy((*mem)[0x0010:], "123456789")
+
+	if v := Checksum(mem, 0x0010, 0x0018); v != 0xcbf43926 {
+		t.Fatalf("expected CRC-32 0xcbf43926, got %#08x", v)
+	}
+	if v := Checksum(ReaderAt{mem}, 0x0010, 0x0018); v != 0xcbf43926 {
+		t.Fatalf("expected CRC-32 0xcbf43926 via ReadAt, got %#08x", v)
+	}
+
+	want := "15e2b0d3c33891ebb0f1ef609ec419420c20e320ce94c65fbc8c3312448eb225"
+	if v := ChecksumSHA256(mem, 0x0010, 0x0018); hex.EncodeToString(v[:]) != want {
+		t.Fatalf("expected SHA-256 %s, got %x", want, v)
+	}
+
+	// The full address space, which ReaderAt can not read
+	if a, b := Checksum(mem, 0x0000, 0xffff), Checksum(ReaderAt{mem}, 0x0000, 0xffff); a != b {
+		t.Fatalf("expected the same checksum via ReadAt, got %#08x and %#08x", a, b)
+	}
+}
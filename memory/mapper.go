@@ -4,25 +4,68 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 )
 
-// Mapper for bank switched memory access.
+// Mapper for bank switched memory access. It is not safe to Map or Unmap while
+// memory is accessed from another goroutine, use SyncMapper for that.
+//
+// Mapped ranges may overlap, where they do the smallest range takes
+// precedence. Of overlapping ranges of equal size, the last mapped one takes
+// precedence.
 type Mapper struct {
 	// Zero value for unmapped areas.
 	Zero uint8
 
 	// mapper memory ranges
 	mapped memoryRanges
+
+	// banks are the disjoint ranges resolved from mapped
+	banks memoryRanges
+
+	// seq is the Map order of the next memory range
+	seq int
 }
 
 // NewMapper creates a new mapper with 0xff as the zero value.
 func NewMapper() *Mapper {
-	return &Mapper{Zero: 0xff}
+	return NewMapperZero(0xff)
+}
+
+// NewMapperZero creates a new mapper that reads zero from unmapped areas.
+func NewMapperZero(zero uint8) *Mapper {
+	return &Mapper{Zero: zero}
+}
+
+// MapEntry is a memory range for BuildMapper.
+type MapEntry struct {
+	// Start and Stop are the first and last address of the range.
+	Start, Stop uint16
+
+	// Mem is the mapped memory.
+	Mem Memory
+}
+
+// BuildMapper creates a new mapper with the entries mapped in order, the
+// usual precedence rules apply where they overlap. It fails if an entry has
+// a reversed range (Stop before Start) or no memory.
+func BuildMapper(entries ...MapEntry) (*Mapper, error) {
+	m := NewMapper()
+	for i, entry := range entries {
+		switch {
+		case entry.Stop < entry.Start:
+			return nil, fmt.Errorf("memory: entry %d has invalid range $%04X-$%04X", i, entry.Start, entry.Stop)
+		case entry.Mem == nil:
+			return nil, fmt.Errorf("memory: entry %d at $%04X-$%04X has no memory", i, entry.Start, entry.Stop)
+		}
+		m.Map(entry.Start, entry.Stop, entry.Mem)
+	}
+	return m, nil
 }
 
 // Fetch a byte
 func (m Mapper) Fetch(addr uint16) uint8 {
-	if memory := m.mapped.Bank(addr); memory != nil {
+	if memory := m.banks.Bank(addr); memory != nil {
 		return memory.Fetch(addr)
 	}
 	return m.Zero
@@ -30,20 +73,53 @@ func (m Mapper) Fetch(addr uint16) uint8 {
 
 // Store a byte
 func (m Mapper) Store(addr uint16, value uint8) {
-	if memory := m.mapped.Bank(addr); memory != nil {
+	if memory := m.banks.Bank(addr); memory != nil {
 		memory.Store(addr, value)
 	}
 }
 
-// Map memory starting at addr; the memory implementation is expected to do
-// the address translation for the specified addr.
+// Map memory starting at addr up to and including stop; the memory
+// implementation is expected to do the address translation for the specified
+// addr.
 func (m *Mapper) Map(addr, stop uint16, memory Memory) {
 	m.mapped = append(m.mapped, memoryRange{
 		Memory: memory,
 		addr:   addr,
 		stop:   stop,
+		seq:    m.seq,
 	})
+	m.seq++
 	m.mapped.Sort()
+	m.banks = m.mapped.resolve()
+}
+
+// MapChecked maps memory like Map, but returns an error instead if the range
+// exactly duplicates or fully shadows an existing range, or if it would be
+// fully shadowed itself.
+func (m *Mapper) MapChecked(addr, stop uint16, memory Memory) error {
+	if stop < addr {
+		return fmt.Errorf("memory: invalid range $%04X-$%04X", addr, stop)
+	}
+
+	var (
+		add    = memoryRange{Memory: memory, addr: addr, stop: stop, seq: m.seq}
+		mapped = append(append(memoryRanges(nil), m.mapped...), add)
+		banks  = mapped.resolve()
+	)
+	for _, it := range m.mapped {
+		switch {
+		case it.addr == addr && it.stop == stop:
+			return fmt.Errorf("memory: %s duplicates %s", add, it)
+		case !banks.visible(it.seq):
+			return fmt.Errorf("memory: %s shadows %s", add, it)
+		}
+	}
+	if !banks.visible(add.seq) {
+		return fmt.Errorf("memory: %s is shadowed by %s", add, m.mapped.overlapping(addr, stop))
+	}
+
+	m.Map(addr, stop, memory)
+	return nil
 }
 
 // Unmap a memory area; returns true if the memory was found. Returns at the
@@ -52,6 +128,7 @@ func (m *Mapper) Unmap(memory Memory) (found bool) {
 	for i, r := range m.mapped {
 		if found = r.Memory == memory; found {
 			m.mapped = append(m.mapped[:i], m.mapped[i+1:]...)
+			m.banks = m.mapped.resolve()
 			return
 		}
 	}
@@ -61,6 +138,7 @@ func (m *Mapper) Unmap(memory Memory) (found bool) {
 // Reset the mappings
 func (m *Mapper) Reset() *Mapper {
 	m.mapped = m.mapped[:0]
+	m.banks = nil
 	return m
 }
 
@@ -68,9 +146,91 @@ func (m Mapper) String() string {
 	return fmt.Sprintf("Mapper{%s}", m.mapped)
 }
 
+// SyncMapper is a Mapper that is safe for concurrent use; mapping changes are
+// serialized against memory accesses.
+type SyncMapper struct {
+	mu     sync.RWMutex
+	mapper Mapper
+}
+
+// NewSyncMapper creates a new concurrency safe mapper with 0xff as the zero
+// value.
+func NewSyncMapper() *SyncMapper {
+	return &SyncMapper{mapper: Mapper{Zero: 0xff}}
+}
+
+// Fetch a byte
+func (m *SyncMapper) Fetch(addr uint16) uint8 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.mapper.Fetch(addr)
+}
+
+// Store a byte
+func (m *SyncMapper) Store(addr uint16, value uint8) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	m.mapper.Store(addr, value)
+}
+
+// Map memory, see Mapper.Map.
+func (m *SyncMapper) Map(addr, stop uint16, memory Memory) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mapper.Map(addr, stop, memory)
+}
+
+// MapChecked maps memory, see Mapper.MapChecked.
+func (m *SyncMapper) MapChecked(addr, stop uint16, memory Memory) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mapper.MapChecked(addr, stop, memory)
+}
+
+// Unmap a memory area, see Mapper.Unmap.
+func (m *SyncMapper) Unmap(memory Memory) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mapper.Unmap(memory)
+}
+
+// Reset the mappings
+func (m *SyncMapper) Reset() *SyncMapper {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mapper.Reset()
+	return m
+}
+
+// SetZero sets the zero value for unmapped areas.
+func (m *SyncMapper) SetZero(zero uint8) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mapper.Zero = zero
+}
+
+func (m *SyncMapper) String() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.mapper.String()
+}
+
 type memoryRange struct {
 	Memory
 	addr, stop uint16
+	seq        int
+}
+
+func (r memoryRange) size() int {
+	return int(r.stop) - int(r.addr) + 1
+}
+
+// precedes returns true if r takes precedence over o where they overlap
+func (r memoryRange) precedes(o memoryRange) bool {
+	if r.size() != o.size() {
+		return r.size() < o.size()
+	}
+	return r.seq > o.seq
 }
 
 func (r memoryRange) String() string {
@@ -108,13 +268,73 @@ func (r memoryRanges) String() string {
 	return strings.Join(s, ", ")
 }
 
+// resolve the overlapping ranges into disjoint ranges sorted by address
+func (r memoryRanges) resolve() memoryRanges {
+	edges := make([]int, 0, len(r)*2)
+	for _, it := range r {
+		edges = append(edges, int(it.addr), int(it.stop)+1)
+	}
+	sort.Ints(edges)
+
+	var out memoryRanges
+	for i := 0; i+1 < len(edges); i++ {
+		lo, hi := edges[i], edges[i+1]-1
+		if lo > hi {
+			continue
+		}
+
+		var (
+			win   memoryRange
+			found bool
+		)
+		for _, it := range r {
+			if int(it.addr) <= lo && hi <= int(it.stop) && (!found || it.precedes(win)) {
+				win, found = it, true
+			}
+		}
+		if !found {
+			continue
+		}
+
+		if n := len(out); n > 0 && out[n-1].seq == win.seq && int(out[n-1].stop)+1 == lo {
+			out[n-1].stop = uint16(hi)
+			continue
+		}
+		win.addr, win.stop = uint16(lo), uint16(hi)
+		out = append(out, win)
+	}
+	return out
+}
+
+// visible returns true if the range mapped as seq is in the resolved ranges
+func (r memoryRanges) visible(seq int) bool {
+	for _, it := range r {
+		if it.seq == seq {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapping returns the ranges overlapping addr up to and including stop
+func (r memoryRanges) overlapping(addr, stop uint16) memoryRanges {
+	var out memoryRanges
+	for _, it := range r {
+		if it.addr <= stop && addr <= it.stop {
+			out = append(out, it)
+		}
+	}
+	return out
+}
+
+// Bank returns the memory at addr, the ranges must be disjoint
 func (r memoryRanges) Bank(addr uint16) Memory {
 	l := len(r)
 	if i := sort.Search(l, func(i int) bool {
 		return addr <= r[i].stop
 	}); i < l {
 		if it := r[i]; addr >= it.addr && addr <= it.stop {
-			return it
+			return it.Memory
 		}
 	}
 	return nil
@@ -1,6 +1,9 @@
 package memory
 
-import "testing"
+import (
+	"sync"
+	"testing"
+)
 
 func TestMapper(t *testing.T) {
 	m := NewMapper()
@@ -86,3 +89,186 @@ func TestMapper(t *testing.T) {
 		t.Logf("0x1234 = %#02x", v)
 	}
 }
+
+func TestMapperOverlap(t *testing.T) {
+	var (
+		a = New(0x1000).Reset(0xaa)
+		b = New(0x1000).Reset(0xbb)
+		c = New(0x2000).Reset(0xcc)
+	)
+	for _, test := range []struct {
+		Name string
+		Map  func(*Mapper)
+		Want map[uint16]uint8
+	}{
+		{
+			"equal size, last mapped wins",
+			func(m *Mapper) {
+				m.Map(0x0000, 0x0fff, Masked{a, 0x0fff})
+				m.Map(0x0800, 0x17ff, Masked{b, 0x0fff})
+			},
+			map[uint16]uint8{0x07ff: 0xaa, 0x0800: 0xbb, 0x0fff: 0xbb, 0x17ff: 0xbb, 0x1800: 0xff},
+		},
+		{
+			"equal size, mapped in reverse",
+			func(m *Mapper) {
+				m.Map(0x0800, 0x17ff, Masked{b, 0x0fff})
+				m.Map(0x0000, 0x0fff, Masked{a, 0x0fff})
+			},
+			map[uint16]uint8{0x07ff: 0xaa, 0x0800: 0xaa, 0x0fff: 0xaa, 0x1000: 0xbb, 0x17ff: 0xbb},
+		},
+		{
+			"smaller range wins",
+			func(m *Mapper) {
+				m.Map(0x1800, 0x27ff, Masked{a, 0x0fff})
+				m.Map(0x0000, 0x1fff, Masked{c, 0x1fff})
+			},
+			map[uint16]uint8{0x17ff: 0xcc, 0x1800: 0xaa, 0x1fff: 0xaa, 0x2000: 0xaa, 0x2800: 0xff},
+		},
+		{
+			"larger range around and after a contained one",
+			func(m *Mapper) {
+				m.Map(0x0000, 0xffff, Masked{c, 0x1fff})
+				m.Map(0x1000, 0x1fff, Masked{a, 0x0fff})
+				m.Map(0x4000, 0x47ff, Masked{b, 0x0fff})
+			},
+			map[uint16]uint8{0x0000: 0xcc, 0x0fff: 0xcc, 0x1000: 0xaa, 0x1fff: 0xaa, 0x2000: 0xcc,
+				0x3fff: 0xcc, 0x4000: 0xbb, 0x47ff: 0xbb, 0x4800: 0xcc, 0xffff: 0xcc},
+		},
+		{
+			"contained range mapped first",
+			func(m *Mapper) {
+				m.Map(0x1000, 0x1fff, Masked{a, 0x0fff})
+				m.Map(0x0000, 0xffff, Masked{c, 0x1fff})
+			},
+			map[uint16]uint8{0x0fff: 0xcc, 0x1000: 0xaa, 0x1fff: 0xaa, 0x2000: 0xcc, 0xffff: 0xcc},
+		},
+	} {
+		m := NewMapper()
+		test.Map(m)
+		for addr, want := range test.Want {
+			if v := m.Fetch(addr); v != want {
+				t.Errorf("%s: expected %#02x at %#04x, got %#02x", test.Name, want, addr, v)
+			}
+		}
+	}
+}
+
+func TestMapperMapChecked(t *testing.T) {
+	var (
+		m = NewMapper()
+		a = New(0x1000)
+		b = New(0x1000)
+	)
+	if err := m.MapChecked(0x0000, 0x0fff, Masked{a, 0x0fff}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.MapChecked(0x0800, 0x17ff, Masked{b, 0x0fff}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.MapChecked(0x2000, 0x2fff, Masked{a, 0x0fff}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.MapChecked(0x2000, 0x27ff, Blank(0x2a)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		Addr, Stop uint16
+		Want       string
+	}{
+		{0x0000, 0x0fff, "memory: $0000-$0FFF: 0x2a duplicates $0000-$0FFF: {4096B RAM 4095}"},
+		{0x0000, 0x17ff, "memory: $0000-$17FF: 0x2a is shadowed by $0000-$0FFF: {4096B RAM 4095}, $0800-$17FF: {4096B RAM 4095}"},
+		{0x2800, 0x2fff, "memory: $2800-$2FFF: 0x2a shadows $2000-$2FFF: {4096B RAM 4095}"},
+		{0x0fff, 0x0000, "memory: invalid range $0FFF-$0000"},
+	} {
+		err := m.MapChecked(test.Addr, test.Stop, Blank(0x2a))
+		if err == nil {
+			t.Errorf("$%04X-$%04X: expected error", test.Addr, test.Stop)
+		} else if err.Error() != test.Want {
+			t.Errorf("$%04X-$%04X: expected error %q, got %q", test.Addr, test.Stop, test.Want, err)
+		}
+	}
+
+	// Nothing was mapped by the failed calls
+	if v := m.Fetch(0x2800); v != 0x00 {
+		t.Fatalf("expected 0x00 at 0x2800, got %#02x", v)
+	}
+}
+
+func TestNewMapperZero(t *testing.T) {
+	if v := NewMapper().Fetch(0x1234); v != 0xff {
+		t.Errorf("expected NewMapper to read $FF unmapped, got $%02X", v)
+	}
+	if v := NewMapperZero(0x00).Fetch(0x1234); v != 0x00 {
+		t.Errorf("expected NewMapperZero(0) to read $00 unmapped, got $%02X", v)
+	}
+}
+
+func TestBuildMapper(t *testing.T) {
+	var (
+		ram = New(0x0800).Reset(0xaa)
+		rom = ROM{0xbb, 0xcc}
+	)
+	m, err := BuildMapper(
+		MapEntry{0x0000, 0x1fff, Masked{ram, 0x07ff}},
+		MapEntry{0xfffe, 0xffff, Masked{rom, 0x0001}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[uint16]uint8{0x0000: 0xaa, 0x1fff: 0xaa, 0x2000: 0xff, 0xfffe: 0xbb, 0xffff: 0xcc} {
+		if v := m.Fetch(addr); v != want {
+			t.Errorf("expected %#02x at %#04x, got %#02x", want, addr, v)
+		}
+	}
+
+	for _, entry := range []MapEntry{
+		{0x2000, 0x1fff, ram},
+		{0x2000, 0x2fff, nil},
+	} {
+		if _, err := BuildMapper(entry); err == nil {
+			t.Errorf("expected error for %+v", entry)
+		}
+	}
+}
+
+func TestSyncMapper(t *testing.T) {
+	var (
+		m  = NewSyncMapper()
+		r  = New(0x10000).Reset(0xaa)
+		wg sync.WaitGroup
+	)
+	if v := m.Fetch(0x1234); v != 0xff {
+		t.Fatalf("expected 0xff at 0x1234, got %#02x", v)
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			m.Map(0x0000, 0xffff, r)
+			m.Unmap(r)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if v := m.Fetch(0x1234); v != 0xaa && v != 0xff {
+				t.Errorf("expected 0xaa or 0xff at 0x1234, got %#02x", v)
+				return
+			}
+			m.Store(0x1234, 0xaa)
+		}
+	}()
+	wg.Wait()
+
+	m.Map(0x0000, 0xffff, r)
+	if v := m.Fetch(0x1234); v != 0xaa {
+		t.Fatalf("expected 0xaa at 0x1234, got %#02x", v)
+	}
+	m.SetZero(0x00)
+	if v := m.Reset().Fetch(0x1234); v != 0x00 {
+		t.Fatalf("expected 0x00 at 0x1234, got %#02x", v)
+	}
+}
@@ -1,5 +1,7 @@
 package memory
 
+import "fmt"
+
 // Masked memory access allows one to restrict and/or translate 16-bit memory
 // to a smaller range.
 type Masked struct {
@@ -10,6 +12,32 @@ type Masked struct {
 	Mask uint16
 }
 
+// NewMasked restricts mem to the first size bytes, which must be a power of
+// two of at most 64kB. If mem is RAM or ROM, it must be at least size bytes.
+func NewMasked(mem Memory, size int) (Masked, error) {
+	if size <= 0 || size > 0x10000 || size&(size-1) != 0 {
+		return Masked{}, fmt.Errorf("memory: mask size %d is not a power of two up to 64kB", size)
+	}
+	var n int
+	switch mem := mem.(type) {
+	case *RAM:
+		n = len(*mem)
+	case ROM:
+		n = len(mem)
+	default:
+		n = size
+	}
+	if n < size {
+		return Masked{}, fmt.Errorf("memory: mask size %d exceeds %s", size, mem)
+	}
+	return Masked{Memory: mem, Mask: uint16(size - 1)}, nil
+}
+
+// EffectiveSize is the size of the addressable memory.
+func (m Masked) EffectiveSize() int {
+	return int(m.Mask) + 1
+}
+
 // Fetch a byte
 func (m Masked) Fetch(addr uint16) uint8 {
 	return m.Memory.Fetch(addr & m.Mask)
@@ -0,0 +1,41 @@
+package memory
+
+import "testing"
+
+func TestNewMasked(t *testing.T) {
+	m, err := NewMasked(New(0x2000), 0x2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Mask != 0x1fff {
+		t.Fatalf("expected mask $1FFF, got $%04X", m.Mask)
+	}
+	if v := m.EffectiveSize(); v != 0x2000 {
+		t.Fatalf("expected size 8192, got %d", v)
+	}
+	m.Store(0x2001, 0x42)
+	if v := m.Fetch(0x0001); v != 0x42 {
+		t.Fatalf("expected store at $2001 to mirror to $0001, got $%02X", v)
+	}
+
+	if m, err = NewMasked(Blank(0), 0x10000); err != nil {
+		t.Fatal(err)
+	} else if v := m.EffectiveSize(); v != 0x10000 {
+		t.Fatalf("expected size 65536, got %d", v)
+	}
+
+	for _, test := range []struct {
+		Memory Memory
+		Size   int
+	}{
+		{New(0x2000), 0},
+		{New(0x2000), 0x1fff},  // Not a power of two
+		{New(0x2000), 0x20000}, // Exceeds address space
+		{New(0x1fff), 0x2000},  // Exceeds RAM
+		{make(ROM, 0x800), 0x1000},
+	} {
+		if _, err := NewMasked(test.Memory, test.Size); err == nil {
+			t.Errorf("%s with size %d: expected error", test.Memory, test.Size)
+		}
+	}
+}
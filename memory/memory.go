@@ -3,7 +3,10 @@ package memory
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
 )
 
 const zeroBlockSize = 128
@@ -18,6 +21,27 @@ func (mem Blank) String() string {
 	return fmt.Sprintf("%#02x", uint8(mem))
 }
 
+// BlankFunc memory always returns the same value, like Blank, and calls
+// OnWrite for writes, which are dropped.
+type BlankFunc struct {
+	Value   uint8
+	OnWrite func(addr uint16, value uint8)
+}
+
+// Fetch returns Value.
+func (mem *BlankFunc) Fetch(_ uint16) uint8 { return mem.Value }
+
+// Store calls OnWrite, if set.
+func (mem *BlankFunc) Store(addr uint16, value uint8) {
+	if mem.OnWrite != nil {
+		mem.OnWrite(addr, value)
+	}
+}
+
+func (mem *BlankFunc) String() string {
+	return fmt.Sprintf("%#02x", mem.Value)
+}
+
 // RAM is Rendom Access Memory.
 type RAM []uint8
 
@@ -49,6 +73,15 @@ func (mem *RAM) Reset(zero uint8) *RAM {
 	return mem
 }
 
+// Randomize RAM with a pseudo-random pattern from seed, overwriting the
+// current memory. The same seed gives the same pattern. This is meant for
+// testing programs that assume cleared RAM, it does not emulate the power-on
+// state of real hardware.
+func (mem *RAM) Randomize(seed int64) *RAM {
+	rand.New(rand.NewSource(seed)).Read(*mem)
+	return mem
+}
+
 func (mem RAM) String() string {
 	return fmt.Sprintf("%s RAM", sizeOf(len(mem)))
 }
@@ -58,7 +91,17 @@ type ROM []uint8
 
 // Load a new ROM.
 func Load(name string) (ROM, error) {
-	b, err := ioutil.ReadFile(name)
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadReader(f)
+}
+
+// LoadReader loads a new ROM from all data read from r.
+func LoadReader(r io.Reader) (ROM, error) {
+	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
@@ -77,6 +120,49 @@ func (mem ROM) String() string {
 	return fmt.Sprintf("%s ROM", sizeOf(len(mem)))
 }
 
+// IO is memory mapped I/O, accesses are handled by the Read and Write
+// functions. A nil Read makes the registers write-only, reads return OpenBus.
+// A nil Write makes them read-only, writes are dropped.
+type IO struct {
+	Read  func(addr uint16) uint8
+	Write func(addr uint16, value uint8)
+
+	// OpenBus is the value read if there is no Read function.
+	OpenBus uint8
+}
+
+// Fetch a byte using Read.
+func (mem *IO) Fetch(addr uint16) uint8 {
+	if mem.Read == nil {
+		return mem.OpenBus
+	}
+	return mem.Read(addr)
+}
+
+// Store a byte using Write.
+func (mem *IO) Store(addr uint16, value uint8) {
+	if mem.Write != nil {
+		mem.Write(addr, value)
+	}
+}
+
+func (mem *IO) String() string {
+	return "IO"
+}
+
+// WatchedROM is Read-Only Memory that reports attempted writes.
+type WatchedROM struct {
+	ROM
+	OnWriteAttempt func(addr uint16, value uint8)
+}
+
+// Store calls OnWriteAttempt, if set, the ROM is not modified.
+func (mem *WatchedROM) Store(addr uint16, value uint8) {
+	if mem.OnWriteAttempt != nil {
+		mem.OnWriteAttempt(addr, value)
+	}
+}
+
 func sizeOf(l int) string {
 	switch {
 	case l >= 8192:
@@ -90,4 +176,8 @@ func sizeOf(l int) string {
 var (
 	_ Memory = (*RAM)(nil)
 	_ Memory = (*ROM)(nil)
+	_ Memory = (*IO)(nil)
+	_ Memory = (*BlankFunc)(nil)
+	_ Memory = (*WatchedROM)(nil)
+	_ Memory = Overlay{}
 )
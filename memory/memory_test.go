@@ -1,6 +1,7 @@
 package memory
 
 import (
+	"bytes"
 	"os"
 	"path/filepath"
 	"testing"
@@ -16,6 +17,122 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestRandomize(t *testing.T) {
+	var (
+		a = New(0x100).Randomize(42)
+		b = New(0x100).Randomize(42)
+		c = New(0x100).Randomize(23)
+	)
+	if !bytes.Equal(*a, *b) {
+		t.Fatal("expected the same pattern for the same seed")
+	}
+	if bytes.Equal(*a, *c) {
+		t.Fatal("expected a different pattern for a different seed")
+	}
+	if bytes.Equal(*a, *New(0x100)) {
+		t.Fatal("expected RAM not to be cleared")
+	}
+}
+
+func TestWatchedROM(t *testing.T) {
+	var (
+		attempts int
+		mem      = &WatchedROM{
+			ROM: ROM{0x00, 0x2a},
+			OnWriteAttempt: func(addr uint16, value uint8) {
+				if addr != 0x0001 || value != 0xff {
+					t.Fatalf("expected write of 0xff to 0x0001, got %#02x to %#04x", value, addr)
+				}
+				attempts++
+			},
+		}
+	)
+	mem.Store(0x0001, 0xff)
+	if attempts != 1 {
+		t.Fatalf("expected 1 write attempt, got %d", attempts)
+	}
+	if v := mem.Fetch(0x0001); v != 0x2a {
+		t.Fatalf("expected 0x2a at 0x0001, got %#02x", v)
+	}
+	if v := mem.String(); v != "2B ROM" {
+		t.Fatalf("expected %q, got %q", "2B ROM", v)
+	}
+}
+
+func TestBlankFunc(t *testing.T) {
+	var (
+		writes []uint16
+		mem    = &BlankFunc{
+			Value: 0x2a,
+			OnWrite: func(addr uint16, value uint8) {
+				writes = append(writes, addr)
+			},
+		}
+	)
+	mem.Store(0x1234, 0xff)
+	if len(writes) != 1 || writes[0] != 0x1234 {
+		t.Fatalf("expected a write to 0x1234, got %v", writes)
+	}
+	if v := mem.Fetch(0x1234); v != 0x2a {
+		t.Fatalf("expected 0x2a at 0x1234, got %#02x", v)
+	}
+
+	// Without OnWrite, writes are dropped silently
+	mem.OnWrite = nil
+	mem.Store(0x1234, 0xff)
+}
+
+func TestIO(t *testing.T) {
+	var (
+		reads, writes int
+		mem           = &IO{
+			Read: func(addr uint16) uint8 {
+				reads++
+				return uint8(addr)
+			},
+			Write: func(addr uint16, value uint8) {
+				writes++
+			},
+		}
+	)
+	if v := mem.Fetch(0x1234); v != 0x34 {
+		t.Fatalf("expected 0x34 at 0x1234, got %#02x", v)
+	}
+	mem.Store(0x1234, 0x2a)
+	if reads != 1 || writes != 1 {
+		t.Fatalf("expected 1 read and 1 write, got %d and %d", reads, writes)
+	}
+}
+
+func TestIOOneWay(t *testing.T) {
+	var (
+		written uint8
+		m       = NewMapper()
+	)
+	m.Map(0x2000, 0x2000, &IO{
+		Write:   func(_ uint16, value uint8) { written = value },
+		OpenBus: 0x20,
+	})
+	m.Map(0x2002, 0x2002, &IO{
+		Read: func(_ uint16) uint8 { return 0x80 },
+	})
+
+	// Write-only
+	m.Store(0x2000, 0x2a)
+	if written != 0x2a {
+		t.Errorf("expected write of 0x2a, got %#02x", written)
+	}
+	if v := m.Fetch(0x2000); v != 0x20 {
+		t.Errorf("expected open bus 0x20 reading a write-only register, got %#02x", v)
+	}
+
+	// Read-only
+	m.Store(0x2002, 0x00)
+	if v := m.Fetch(0x2002); v != 0x80 {
+		t.Errorf("expected 0x80 from a read-only register, got %#02x", v)
+	}
+}
+
 func TestLoad(t *testing.T) {
 	mem, err := Load(filepath.Join("testdata", "zero.rom"))
 	if err != nil && os.IsNotExist(err) {
@@ -42,6 +159,19 @@ func TestLoadError(t *testing.T) {
 	}
 }
 
+func TestLoadReader(t *testing.T) {
+	mem, err := LoadReader(bytes.NewReader([]byte{0x00, 0x2a}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := mem.Fetch(0x0001); v != 0x2a {
+		t.Fatalf("expected 0x2a at 0x0001, got %#02x", v)
+	}
+	if v := mem.String(); v != "2B ROM" {
+		t.Fatalf("expected %q, got %q", "2B ROM", v)
+	}
+}
+
 func TestSizeOf(t *testing.T) {
 	for _, test := range []struct {
 		Size int
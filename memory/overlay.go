@@ -0,0 +1,33 @@
+package memory
+
+import "fmt"
+
+// Overlay memory shadows the range From up to and including To of Base with
+// Over, for example to patch a ROM with RAM. Over is addressed relative to
+// From, so it only has to cover the size of the range. Accesses outside of
+// the range go to Base.
+type Overlay struct {
+	Base, Over Memory
+	From, To   uint16
+}
+
+// Fetch a byte
+func (m Overlay) Fetch(addr uint16) uint8 {
+	if addr >= m.From && addr <= m.To {
+		return m.Over.Fetch(addr - m.From)
+	}
+	return m.Base.Fetch(addr)
+}
+
+// Store a byte
+func (m Overlay) Store(addr uint16, value uint8) {
+	if addr >= m.From && addr <= m.To {
+		m.Over.Store(addr-m.From, value)
+		return
+	}
+	m.Base.Store(addr, value)
+}
+
+func (m Overlay) String() string {
+	return fmt.Sprintf("%s with %s at $%04X-$%04X", m.Base, m.Over, m.From, m.To)
+}
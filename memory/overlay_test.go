@@ -0,0 +1,47 @@
+package memory
+
+import "testing"
+
+func TestOverlay(t *testing.T) {
+	rom := make(ROM, 0x100)
+	for i := range rom {
+		rom[i] = uint8(i)
+	}
+	mem := Overlay{
+		Base: rom,
+		Over: New(16).Reset(0xea),
+		From: 0x0010,
+		To:   0x001f,
+	}
+
+	for _, test := range []struct {
+		Addr  uint16
+		Value uint8
+	}{
+		{0x000f, 0x0f},
+		{0x0010, 0xea},
+		{0x001f, 0xea},
+		{0x0020, 0x20},
+	} {
+		if v := mem.Fetch(test.Addr); v != test.Value {
+			t.Errorf("expected $%02X at $%04X, got $%02X", test.Value, test.Addr, v)
+		}
+	}
+
+	mem.Store(0x0012, 0x42)
+	if v := mem.Fetch(0x0012); v != 0x42 {
+		t.Fatalf("expected store in overlay, got $%02X", v)
+	}
+	if v := mem.Over.Fetch(0x0002); v != 0x42 {
+		t.Fatalf("expected overlay to be addressed from $0010, got $%02X", v)
+	}
+
+	mem.Store(0x0020, 0x42)
+	if v := mem.Fetch(0x0020); v != 0x20 {
+		t.Fatalf("expected store outside the overlay to be dropped by ROM, got $%02X", v)
+	}
+
+	if v, want := mem.String(), "256B ROM with 16B RAM at $0010-$001F"; v != want {
+		t.Fatalf("expected %q, got %q", want, v)
+	}
+}
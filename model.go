@@ -1,5 +1,7 @@
 package mos65xx
 
+import "fmt"
+
 // Frequency scale
 const (
 	Hz  = 1
@@ -7,16 +9,87 @@ const (
 	MHz = 1000 * KHz
 )
 
+// DefaultStackBase is the stack page of the 6502 family
+const DefaultStackBase = 0x0100
+
 // Model of the MOS Technology 65xx (or compatible) CPU
+//
+// There is no option for the store cycle timing: indexed stores always take
+// the cycle to fix up the high byte of the address, whether a page is crossed
+// or not. The opcode table counts it in the base cycles (see
+// AddressMode.StorePenalty), so the store cycle counts are always accurate.
 type Model struct {
 	Name           string
 	Frequency      float64 // Typical clock frequency in Hz
-	ExternalMemory int     // External addressable memory size
+	ExternalMemory int     // External addressable memory size, the address bus is masked to it
 	InternalMemory int     // Internal RAM size
 	HasBCD         bool    // Decimal mode support
 	HasIRQ         bool    // IRQ support
 	HasNMI         bool    // NMI support
 	HasReady       bool    // RDY support
+	StackBase      uint16  // Stack page start, defaults to DefaultStackBase
+	NMIVector      uint16  // NMI vector, defaults to NMIVector
+	ResetVector    uint16  // Reset vector, defaults to ResetVector
+	IRQVector      uint16  // IRQ/BRK vector, defaults to IRQVector
+
+	// DummyReads enables the dummy read at the unfixed address for indexed
+	// addressing, as performed by the hardware when a page boundary is
+	// crossed and for all indexed stores and read-modify-write instructions.
+	// It also enables the throwaway reads of the pull instructions PLA, PLP,
+	// RTI and RTS, and the three stack reads of the reset sequence: with
+	// DummyReads, Reset decrements S by three from its prior value instead
+	// of setting it to $FD. This matters for memory mapped I/O with read
+	// side effects.
+	DummyReads bool
+
+	// DummyWrites enables the dummy write of the unmodified value performed
+	// by read-modify-write instructions before the modified value is written.
+	// This matters for memory mapped I/O that latches on any write.
+	DummyWrites bool
+
+	// StrictLegal halts the CPU with HaltIllegalOpcode when an undocumented
+	// opcode is fetched, instead of executing it.
+	StrictLegal bool
+
+	// PollInterrupts masks IRQs with the I flag as sampled at the hardware
+	// polling point, at the end of the previous instruction. CLI, SEI and PLP
+	// change I after that point, so their effect on interrupt recognition is
+	// delayed by one instruction, RTI takes effect immediately. Without it,
+	// a requested IRQ is taken at the next instruction regardless of I.
+	PollInterrupts bool
+
+	// HasIOPort enables the on-chip I/O port of the 6510 family, with the
+	// data direction register at $0000 and the data register at $0001. Reads
+	// of these addresses return the port registers instead of memory, writes
+	// update the port and are also passed on to memory, as on the hardware.
+	HasIOPort bool
+}
+
+// Validate checks if the model can be emulated: the internal and external
+// memory sizes must be zero or a power of two of at most 64kB, and the stack
+// base must be the start of a page.
+func (model Model) Validate() error {
+	if n := model.InternalMemory; !validMemorySize(n) {
+		return fmt.Errorf("mos65xx: %s: internal memory size %d is not a power of two up to 64kB", model.Name, n)
+	}
+	if n := model.ExternalMemory; !validMemorySize(n) {
+		return fmt.Errorf("mos65xx: %s: external memory size %d is not a power of two up to 64kB", model.Name, n)
+	}
+	if model.StackBase&0xff != 0 {
+		return fmt.Errorf("mos65xx: %s: stack base $%04X is not the start of a page", model.Name, model.StackBase)
+	}
+	return nil
+}
+
+// WithFrequency returns a copy of the model with the clock frequency in Hz,
+// such as the PAL variant of an NTSC model.
+func (model Model) WithFrequency(f float64) Model {
+	model.Frequency = f
+	return model
+}
+
+func validMemorySize(n int) bool {
+	return n >= 0 && n <= 0x10000 && n&(n-1) == 0
 }
 
 // Models
@@ -72,33 +145,37 @@ var (
 
 	MOS6510 = Model{
 		Name:           "MOS Technology 6510",
-		Frequency:      1.023 * MHz, // On NTSC, for PAL use 0.985 MHz
+		Frequency:      1.023 * MHz, // On NTSC, for PAL use WithFrequency(0.985 * MHz)
 		ExternalMemory: 0x10000,
 		HasBCD:         true,
+		HasIOPort:      true,
 		HasNMI:         true,
 		HasReady:       true,
 	}
 
 	MOS6510T = Model{
 		Name:           "MOS Technology 6510T",
-		Frequency:      1.023 * MHz, // On NTSC, for PAL use 0.985 MHz
+		Frequency:      1.023 * MHz, // On NTSC, for PAL use WithFrequency(0.985 * MHz)
 		ExternalMemory: 0x10000,
 		HasBCD:         true,
+		HasIOPort:      true,
 	}
 
 	MOS7501 = Model{
 		Name:           "MOS Technology 7501",
-		Frequency:      1.023 * MHz, // On NTSC, for PAL use 0.985 MHz
+		Frequency:      1.023 * MHz, // On NTSC, for PAL use WithFrequency(0.985 * MHz)
 		ExternalMemory: 0x10000,
 		HasBCD:         true,
+		HasIOPort:      true,
 		HasReady:       true,
 	}
 
 	MOS8501 = Model{
 		Name:           "MOS Technology 8501",
-		Frequency:      1.023 * MHz, // On NTSC, for PAL use 0.985 MHz
+		Frequency:      1.023 * MHz, // On NTSC, for PAL use WithFrequency(0.985 * MHz)
 		ExternalMemory: 0x10000,
 		HasBCD:         true,
+		HasIOPort:      true,
 		HasReady:       true,
 	}
 
@@ -107,6 +184,7 @@ var (
 		Frequency:      2 * MHz,
 		ExternalMemory: 0x10000,
 		HasBCD:         true,
+		HasIOPort:      true,
 		HasNMI:         true,
 		HasReady:       true,
 	}
@@ -0,0 +1,102 @@
+package mos65xx
+
+import (
+	"testing"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+func TestModelValidate(t *testing.T) {
+	for _, size := range []int{0, 0x80, 0x10000} {
+		model := MOS6507
+		model.InternalMemory = size
+		if err := model.Validate(); err != nil {
+			t.Errorf("internal memory %d: unexpected error %v", size, err)
+		}
+	}
+	for _, size := range []int{-1, 100, 0x20000} {
+		model := MOS6507
+		model.InternalMemory = size
+		if err := model.Validate(); err == nil {
+			t.Errorf("internal memory %d: expected error", size)
+		}
+	}
+
+	model := MOS6507
+	model.ExternalMemory = 0x3000
+	if err := model.Validate(); err == nil {
+		t.Error("external memory 12288: expected error")
+	}
+
+	model = MOS6502
+	model.StackBase = 0x0180
+	if err := model.Validate(); err == nil {
+		t.Error("stack base $0180: expected error")
+	}
+	model.StackBase = 0x0200
+	if err := model.Validate(); err != nil {
+		t.Errorf("stack base $0200: unexpected error %v", err)
+	}
+}
+
+func TestModelWithFrequency(t *testing.T) {
+	pal := MOS6510.WithFrequency(0.985 * MHz)
+	if pal.Frequency != 0.985*MHz {
+		t.Errorf("expected %f Hz, got %f", 0.985*MHz, pal.Frequency)
+	}
+	if MOS6510.Frequency != 1.023*MHz {
+		t.Errorf("expected the original to keep %f Hz, got %f", 1.023*MHz, MOS6510.Frequency)
+	}
+	if pal.Name != MOS6510.Name || pal.HasIOPort != MOS6510.HasIOPort {
+		t.Error("expected the other fields to be copied")
+	}
+}
+
+func TestModelInternalMemory(t *testing.T) {
+	// No internal memory, everything goes to the bus
+	mem := memory.New(0x10000)
+	cpu := New(MOS6507, mem)
+	cpu.Store(0x0010, 0x2a)
+	if v := mem.Fetch(0x0010); v != 0x2a {
+		t.Fatalf("expected $2A on the bus, got $%02X", v)
+	}
+
+	// 128 bytes of internal memory shadow the bus
+	model := MOS6507
+	model.InternalMemory = 0x80
+	mem = memory.New(0x10000)
+	cpu = New(model, mem)
+	cpu.Store(0x0010, 0x2a)
+	if v := mem.Fetch(0x0010); v != 0x00 {
+		t.Fatalf("expected $00 on the bus, got $%02X", v)
+	}
+	if v := cpu.Fetch(0x0010); v != 0x2a {
+		t.Fatalf("expected $2A in internal memory, got $%02X", v)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected New to panic for a non power of two internal memory size")
+		}
+	}()
+	model.InternalMemory = 100
+	New(model, mem)
+}
+
+func TestModelExternalMemory(t *testing.T) {
+	mem := memory.New(0x10000)
+	cpu := New(MOS6507, mem) // 13 address lines
+	cpu.Store(0x2000, 0x2a)
+	if v := mem.Fetch(0x0000); v != 0x2a {
+		t.Fatalf("expected $2000 to wrap to $0000, got $%02X at $0000", v)
+	}
+	if v := cpu.Fetch(0xe000); v != 0x2a {
+		t.Fatalf("expected $E000 to wrap to $0000, got $%02X", v)
+	}
+
+	cpu = New(MOS6502, mem)
+	cpu.Store(0x2000, 0x55)
+	if v := mem.Fetch(0x2000); v != 0x55 {
+		t.Fatalf("expected $55 at $2000, got $%02X", v)
+	}
+}
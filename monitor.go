@@ -2,6 +2,7 @@ package mos65xx
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"strings"
@@ -12,13 +13,20 @@ const (
 	// FormatDefault resembles neskell's output format
 	FormatDefault = `{{printf "%07d %04X %02X %02X %02X %02X:%s %02X %02X:%s %-7s %-9s %s" .C .PC .A .X .Y .P .PS .S .I .M .Operand .Fetch .Store}}`
 
-	// FormatNintendulator resembles nintendulator's output format
-	FormatNintendulator = `{{printf "%04X %-9s %s %-27s A:%02X X:%02X Y:%02X P:%02X SP:%02x" .PC .RawX .Mnemonic .Operand .A .X .Y .P .S}}`
+	// FormatNintendulator is nintendulator's output format, as used by
+	// nestest.log, undocumented opcodes are marked with a "*". The PPU column
+	// is only included if the CPU has a PPU position, see SetPPUPosition.
+	// Operands are annotated with the memory contents, see OperandAnnotated.
+	FormatNintendulator = `{{printf "%04X  %-8s %1s%-31s A:%02X X:%02X Y:%02X P:%02X SP:%02X %sCYC:%d" .PC .RawX .Mark .AsmAnnotated .A .X .Y .P .S .PPU .CYC}}`
 )
 
 var (
 	// InstructionFormat is the default instruction format
 	InstructionFormat = FormatDefault
+
+	// BranchOffsets renders the operand of relative branches as the raw
+	// offset byte instead of the target address.
+	BranchOffsets = false
 )
 
 // Instruction describes an instruction that's about to be executed
@@ -27,19 +35,67 @@ type Instruction struct {
 	CPU CPU
 
 	// Cycles elapsed
-	Cycles int
+	Cycles int64
 
 	// Mnemonic is the current operation
 	Mnemonic
 
-	// Registers state for instruction
+	// Registers is a snapshot of the registers taken when the instruction
+	// was decoded, before execution
 	Registers
 
 	// AddressMode is the addressing mode for this instruction
 	AddressMode
 
-	// Raw opcode and address bytes
+	// Size of the instruction in bytes
+	Size int
+
+	// BaseCycles is the number of cycles without penalties
+	BaseCycles int
+
+	// PageCrossCycles is the penalty if a page boundary is crossed
+	PageCrossCycles int
+
+	// Raw opcode and address bytes; when passed to a Monitor, Raw is only
+	// valid during the callback and must be copied to be retained.
 	Raw []byte
+
+	// Truncated is true if a disassembled instruction runs past the end of
+	// the address space, Raw then only holds the bytes up to $FFFF.
+	Truncated bool
+}
+
+// String returns the address, mnemonic and operand of the instruction, it does
+// not access the CPU.
+func (in Instruction) String() string {
+	return strings.TrimRight(fmt.Sprintf("%04X %s %s", in.Registers.PC, in.Mnemonic, in.Operand()), " ")
+}
+
+// IsUndocumented returns true if the opcode is not part of the documented
+// instruction set, including the NOP variants and the SBC duplicate ($EB).
+func (in Instruction) IsUndocumented() bool {
+	if len(in.Raw) == 0 {
+		return !in.Mnemonic.IsLegal()
+	}
+	return !documented(in.Raw[0])
+}
+
+// MarshalJSON encodes the registers, mnemonic, address mode and raw bytes of
+// the instruction.
+func (in Instruction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Cycles      int64
+		Mnemonic    string
+		Registers   Registers
+		AddressMode string
+		Raw         string
+	}{
+		in.Cycles,
+		in.Mnemonic.String(),
+		in.Registers,
+		in.AddressMode.String(),
+		fmt.Sprintf("%X", in.Raw),
+	})
 }
 
 // Addr is the operand address for the current instruction.
@@ -68,20 +124,9 @@ func (in Instruction) Addr() (addr uint16) {
 	case Indirect:
 		addr = FetchWord(in.CPU, in.Registers.PC+1)
 	case IndexedIndirect:
-		addr = uint16(in.CPU.Fetch(in.Registers.PC+1) + in.Registers.X)
-		var (
-			lo = uint16(in.CPU.Fetch((addr)))
-			hi = uint16(in.CPU.Fetch((addr + 1) & 0x00ff))
-		)
-		addr = (hi << 8) | lo
+		addr = FetchWordZP(in.CPU, in.CPU.Fetch(in.Registers.PC+1)+in.Registers.X)
 	case IndirectIndexed:
-		addr = uint16(in.CPU.Fetch(in.Registers.PC + 1))
-		var (
-			lo = uint16(in.CPU.Fetch((addr)))
-			hi = uint16(in.CPU.Fetch((addr + 1) & 0x00ff))
-		)
-		addr = (hi << 8) | lo
-		addr += uint16(in.Registers.Y)
+		addr = FetchWordZP(in.CPU, in.CPU.Fetch(in.Registers.PC+1)) + uint16(in.Registers.Y)
 	default:
 	}
 	return
@@ -102,7 +147,7 @@ func (in Instruction) fetches(cpu CPU) (out string) {
 		switch in.AddressMode {
 		case Indirect:
 			addr := in.Addr()
-			out = fmt.Sprintf("%04X→%04X", addr, FetchWord(in.CPU, addr))
+			out = fmt.Sprintf("%04X→%04X", addr, FetchWordBug(in.CPU, addr))
 		case IndirectIndexed, IndexedIndirect:
 			addr := in.Addr()
 			out = fmt.Sprintf("%04X→%02X", addr, in.CPU.Fetch(addr))
@@ -216,19 +261,19 @@ func (in Instruction) stores(cpu CPU) (out string) {
 		}
 		s = append(s, fmt.Sprintf("%02X→SR", p))
 	case JSR:
-		s = append(s, fmt.Sprintf("%02X→%04X", (in.Registers.PC+2)>>8, 0x0100|uint16(in.Registers.S)))
-		s = append(s, fmt.Sprintf("%02X→%04X", (in.Registers.PC+2)&0xff, 0x0100|uint16(in.Registers.S-1)))
+		s = append(s, fmt.Sprintf("%02X→%04X", (in.Registers.PC+2)>>8, in.stack(in.Registers.S)))
+		s = append(s, fmt.Sprintf("%02X→%04X", (in.Registers.PC+2)&0xff, in.stack(in.Registers.S-1)))
 		s = append(s, fmt.Sprintf("%02X→SP", in.Registers.S-2))
 		s = append(s, fmt.Sprintf("%04X→PC", in.Addr()))
 	case RTI:
 		s = append(s, fmt.Sprintf("%02X→SP", in.Registers.S+1))
-		s = append(s, fmt.Sprintf("%02X→SR", (in.CPU.Fetch(0x0100|uint16(in.Registers.S+1))&0xef)|0x20))
-		s = append(s, fmt.Sprintf("%04X→PC", FetchWord(in.CPU, 0x0100|uint16(in.Registers.S+2))+1))
+		s = append(s, fmt.Sprintf("%02X→SR", in.CPU.Fetch(in.stack(in.Registers.S+1))&^B|U))
+		s = append(s, fmt.Sprintf("%04X→PC", FetchWord(in.CPU, in.stack(in.Registers.S+2))+1))
 		s = append(s, fmt.Sprintf("%02X→SP", in.Registers.S+3))
 
 	case RTS:
 		s = append(s, fmt.Sprintf("%02X→SP", in.Registers.S+2))
-		s = append(s, fmt.Sprintf("%04X→PC", FetchWord(in.CPU, 0x0100|uint16(in.Registers.S+1))+1))
+		s = append(s, fmt.Sprintf("%04X→PC", FetchWord(in.CPU, in.stack(in.Registers.S+1))+1))
 	case CLC:
 		s = append(s, fmt.Sprintf("%02X→SR", in.Registers.P & ^C))
 	case CLD:
@@ -244,10 +289,10 @@ func (in Instruction) stores(cpu CPU) (out string) {
 	case SEI:
 		s = append(s, fmt.Sprintf("%02X→SR", in.Registers.P|I))
 	case PHA:
-		s = append(s, fmt.Sprintf("%02X→%04X", in.Registers.A, 0x0100|uint16(in.Registers.S)))
+		s = append(s, fmt.Sprintf("%02X→%04X", in.Registers.A, in.stack(in.Registers.S)))
 		s = append(s, fmt.Sprintf("%02X→SP", in.Registers.S-1))
 	case PHP:
-		s = append(s, fmt.Sprintf("%02X→%04X", in.Registers.P|B, 0x0100|uint16(in.Registers.S)))
+		s = append(s, fmt.Sprintf("%02X→%04X", in.Registers.P|B|U, in.stack(in.Registers.S)))
 		s = append(s, fmt.Sprintf("%02X→SP", in.Registers.S-1))
 	case AND:
 		var (
@@ -413,7 +458,7 @@ func (in Instruction) stores(cpu CPU) (out string) {
 	case PLA:
 		var (
 			p = in.Registers.P
-			v = in.CPU.Fetch(0x0100 | uint16(in.Registers.S+1))
+			v = in.CPU.Fetch(in.stack(in.Registers.S + 1))
 		)
 		if v&0x80 == 0x80 {
 			p |= N
@@ -430,7 +475,7 @@ func (in Instruction) stores(cpu CPU) (out string) {
 		s = append(s, fmt.Sprintf("%02X→A", v))
 	case PLP:
 		var (
-			p = (in.CPU.Fetch(0x0100|uint16(in.Registers.S+1)) & 0xef) | 0x20
+			p = in.CPU.Fetch(in.stack(in.Registers.S+1))&^B | U
 		)
 		s = append(s, fmt.Sprintf("%02X→SP", in.Registers.S+1))
 		s = append(s, fmt.Sprintf("%02X→SR", p))
@@ -464,67 +509,272 @@ func (in Instruction) stores(cpu CPU) (out string) {
 	return strings.Join(s, " ")
 }
 
-// Operand formats the instruction's mnemonic arguments
-func (in Instruction) operand(cpu CPU) (out string) {
+// Operand formats the instruction's mnemonic arguments from the raw bytes.
+// Relative branches are rendered as their target address, see BranchOffsets.
+func (in Instruction) Operand() (out string) {
+	var (
+		b uint8  // Operand byte
+		w uint16 // Operand word
+	)
+	if len(in.Raw) > 1 {
+		b = in.Raw[1]
+		w = uint16(b)
+	}
+	if len(in.Raw) > 2 {
+		w |= uint16(in.Raw[2]) << 8
+	}
 	switch in.AddressMode {
 	case Accumulator:
 		out = "A"
 	case Immediate:
-		out = fmt.Sprintf("#$%02X", in.CPU.Fetch(in.Registers.PC+1))
+		out = fmt.Sprintf("#$%02X", b)
 	case Absolute:
-		out = fmt.Sprintf("$%04X", FetchWord(in.CPU, in.Registers.PC+1))
+		out = fmt.Sprintf("$%04X", w)
 	case AbsoluteX:
-		out = fmt.Sprintf("$%04X,X", FetchWord(in.CPU, in.Registers.PC+1))
+		out = fmt.Sprintf("$%04X,X", w)
 	case AbsoluteY:
-		out = fmt.Sprintf("$%04X,Y", FetchWord(in.CPU, in.Registers.PC+1))
+		out = fmt.Sprintf("$%04X,Y", w)
 	case Relative:
-		out = fmt.Sprintf("$%02X", in.CPU.Fetch(in.Registers.PC+1))
+		if BranchOffsets {
+			out = fmt.Sprintf("$%02X", b)
+		} else {
+			out = fmt.Sprintf("$%04X", in.Registers.PC+2+uint16(int8(b)))
+		}
 	case Indirect:
-		var (
-			lo   = uint16(in.CPU.Fetch(in.Registers.PC + 1))
-			hi   = uint16(in.CPU.Fetch(in.Registers.PC + 2))
-			addr = (hi << 8) | lo
-		)
-		out = fmt.Sprintf("($%04X)", addr)
+		out = fmt.Sprintf("($%04X)", w)
 	case IndexedIndirect:
-		out = fmt.Sprintf("($%02X,X)", in.CPU.Fetch(in.Registers.PC+1))
+		out = fmt.Sprintf("($%02X,X)", b)
 	case IndirectIndexed:
-		out = fmt.Sprintf("($%02X),Y", in.CPU.Fetch(in.Registers.PC+1))
+		out = fmt.Sprintf("($%02X),Y", b)
 	case ZeroPage:
-		out = fmt.Sprintf("$%02X", in.CPU.Fetch(in.Registers.PC+1))
+		out = fmt.Sprintf("$%02X", b)
 	case ZeroPageX:
-		out = fmt.Sprintf("$%02X,X", in.CPU.Fetch(in.Registers.PC+1))
+		out = fmt.Sprintf("$%02X,X", b)
 	case ZeroPageY:
-		out = fmt.Sprintf("$%02X,Y", in.CPU.Fetch(in.Registers.PC+1))
+		out = fmt.Sprintf("$%02X,Y", b)
 	}
 	return
 }
 
+// OperandVerbose formats the instruction's mnemonic arguments, including the
+// resolved pointer and effective address for indirect and indexed modes, for
+// example "($FB),Y = $1234 @ $1240". Memory is read from the cpu, if it is
+// nil only the operand is returned.
+func (in Instruction) OperandVerbose(cpu CPU) string {
+	out := in.Operand()
+	if len(in.Raw) < 2 || cpu == nil {
+		return out
+	}
+	var (
+		b = in.Raw[1]
+		r = in.Registers
+	)
+	switch in.AddressMode {
+	case ZeroPageX:
+		out += fmt.Sprintf(" @ $%02X", b+r.X)
+	case ZeroPageY:
+		out += fmt.Sprintf(" @ $%02X", b+r.Y)
+	case AbsoluteX, AbsoluteY:
+		var (
+			base  = uint16(b)
+			index = r.X
+		)
+		if len(in.Raw) > 2 {
+			base |= uint16(in.Raw[2]) << 8
+		}
+		if in.AddressMode == AbsoluteY {
+			index = r.Y
+		}
+		out += fmt.Sprintf(" @ $%04X", base+uint16(index))
+	case Indirect:
+		if len(in.Raw) > 2 {
+			out += fmt.Sprintf(" = $%04X", FetchWordBug(cpu, uint16(b)|uint16(in.Raw[2])<<8))
+		}
+	case IndexedIndirect:
+		zp := b + r.X
+		out += fmt.Sprintf(" @ $%02X = $%04X", zp, FetchWordZP(cpu, zp))
+	case IndirectIndexed:
+		ptr := FetchWordZP(cpu, b)
+		out += fmt.Sprintf(" = $%04X @ $%04X", ptr, ptr+uint16(r.Y))
+	}
+	return out
+}
+
+// OperandAnnotated formats the instruction's mnemonic arguments the way
+// nintendulator does, with the effective address and the memory contents
+// before execution, for example "($80,X) @ 80 = 0200 = 5A". Memory is read
+// from the cpu, if it is nil only the operand is returned.
+func (in Instruction) OperandAnnotated(cpu CPU) string {
+	out := in.Operand()
+	if len(in.Raw) < 2 || cpu == nil {
+		return out
+	}
+	var (
+		b = in.Raw[1]
+		w = uint16(b)
+		r = in.Registers
+	)
+	if len(in.Raw) > 2 {
+		w |= uint16(in.Raw[2]) << 8
+	}
+	switch in.AddressMode {
+	case ZeroPage:
+		out += fmt.Sprintf(" = %02X", cpu.Fetch(w))
+	case ZeroPageX, ZeroPageY:
+		zp := b + r.X
+		if in.AddressMode == ZeroPageY {
+			zp = b + r.Y
+		}
+		out += fmt.Sprintf(" @ %02X = %02X", zp, cpu.Fetch(uint16(zp)))
+	case Absolute:
+		if in.Mnemonic != JMP && in.Mnemonic != JSR {
+			out += fmt.Sprintf(" = %02X", cpu.Fetch(w))
+		}
+	case AbsoluteX, AbsoluteY:
+		addr := w + uint16(r.X)
+		if in.AddressMode == AbsoluteY {
+			addr = w + uint16(r.Y)
+		}
+		out += fmt.Sprintf(" @ %04X = %02X", addr, cpu.Fetch(addr))
+	case Indirect:
+		// Like nintendulator, ignore the page wrap of the pointer
+		out += fmt.Sprintf(" = %04X", FetchWord(cpu, w))
+	case IndexedIndirect:
+		var (
+			zp   = b + r.X
+			addr = FetchWordZP(cpu, zp)
+		)
+		out += fmt.Sprintf(" @ %02X = %04X = %02X", zp, addr, cpu.Fetch(addr))
+	case IndirectIndexed:
+		var (
+			ptr  = FetchWordZP(cpu, b)
+			addr = ptr + uint16(r.Y)
+		)
+		out += fmt.Sprintf(" = %04X @ %04X = %02X", ptr, addr, cpu.Fetch(addr))
+	}
+	return out
+}
+
+// InstructionCycles returns the number of cycles the instruction will take,
+// including the page cross and branch taken penalties for the current register
+// state. Memory is read from the cpu.
+func (in Instruction) InstructionCycles(cpu CPU) int {
+	var (
+		r = in.Registers
+		n = in.BaseCycles
+	)
+	if len(in.Raw) < 2 {
+		return n
+	}
+
+	var (
+		b = uint16(in.Raw[1])
+		w = b
+	)
+	if len(in.Raw) > 2 {
+		w |= uint16(in.Raw[2]) << 8
+	}
+
+	switch in.AddressMode {
+	case AbsoluteX:
+		if differentPage(w, w+uint16(r.X)) {
+			n += in.PageCrossCycles
+		}
+	case AbsoluteY:
+		if differentPage(w, w+uint16(r.Y)) {
+			n += in.PageCrossCycles
+		}
+	case IndirectIndexed:
+		ptr := uint16(cpu.Fetch(b)) | uint16(cpu.Fetch(uint16(uint8(b+1))))<<8
+		if differentPage(ptr, ptr+uint16(r.Y)) {
+			n += in.PageCrossCycles
+		}
+	case Relative:
+		if branchTaken(in.Mnemonic, r.P) {
+			var (
+				next   = r.PC + 2
+				target = next + uint16(int8(b))
+			)
+			n++
+			if differentPage(next, target) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// branchTaken returns true if the branch instruction is taken for status p
+func branchTaken(m Mnemonic, p uint8) bool {
+	switch m {
+	case BCC:
+		return p&C == 0
+	case BCS:
+		return p&C == C
+	case BNE:
+		return p&Z == 0
+	case BEQ:
+		return p&Z == Z
+	case BPL:
+		return p&N == 0
+	case BMI:
+		return p&N == N
+	case BVC:
+		return p&V == 0
+	case BVS:
+		return p&V == V
+	}
+	return false
+}
+
+// trapped returns true if the instruction jumps or branches to itself, which
+// is a tight loop that can only be left by an interrupt
+func (in Instruction) trapped() bool {
+	switch in.Mnemonic {
+	case JMP, JSR:
+		addr := in.Addr()
+		if in.AddressMode == Indirect {
+			addr = FetchWordBug(in.CPU, addr)
+		}
+		return in.Registers.PC == addr
+	default:
+		return branchTaken(in.Mnemonic, in.Registers.P) && in.Addr() == in.Registers.PC
+	}
+}
+
+// stack returns the stack address for stack pointer s
+func (in Instruction) stack(s uint8) uint16 {
+	return in.CPU.StackBase() | uint16(s)
+}
+
 // Format returns a formatted string based on the format template for the
 // referenced CPU.
 func (in Instruction) Format(format string, cpu CPU) string {
 	var (
 		t = template.Must(template.New("instruction").Parse(format))
 		b = new(bytes.Buffer)
-		d = map[string]interface{}{
-			"B":       in.CPU,
-			"Mode":    in.AddressMode,
-			"C":       in.Cycles,
-			"M":       in.Mnemonic,
-			"R":       in.Registers,
-			"PC":      in.Registers.PC,
-			"P":       in.Registers.P,
-			"PS":      fmtP(in.Registers.P),
-			"S":       in.Registers.S,
-			"A":       in.Registers.A,
-			"X":       in.Registers.X,
-			"Y":       in.Registers.Y,
-			"Raw":     in.Raw,
-			"I":       in.Raw[0],
-			"RawX":    padX(in.Raw),
-			"Operand": in.operand(cpu),
-			"Fetch":   in.fetches(cpu),
-			"Store":   in.stores(cpu),
+		d = formatData{
+			in:      in,
+			cpu:     cpu,
+			B:       in.CPU,
+			Mode:    in.AddressMode,
+			C:       in.Cycles,
+			CYC:     in.Cycles,
+			M:       in.Mnemonic,
+			R:       in.Registers,
+			PC:      in.Registers.PC,
+			P:       in.Registers.P,
+			PS:      fmtP(in.Registers.P),
+			S:       in.Registers.S,
+			A:       in.Registers.A,
+			X:       in.Registers.X,
+			Y:       in.Registers.Y,
+			Raw:     in.Raw,
+			I:       in.Raw[0],
+			RawX:    padX(in.Raw),
+			Operand: in.Operand(),
+			Asm:     strings.TrimRight(in.Mnemonic.String()+" "+in.Operand(), " "),
+			Mark:    mark(in),
 		}
 	)
 	if err := t.Execute(b, d); err != nil {
@@ -533,6 +783,66 @@ func (in Instruction) Format(format string, cpu CPU) string {
 	return b.String()
 }
 
+// formatData is the data for the instruction formats, the columns that read
+// memory or the CPU are methods, so they are only evaluated if used
+type formatData struct {
+	in  Instruction
+	cpu CPU
+
+	B                      CPU
+	Mode                   AddressMode
+	C, CYC                 int64
+	M                      Mnemonic
+	R                      Registers
+	PC                     uint16
+	P, S, A, X, Y, I       uint8
+	PS, RawX, Operand, Asm string
+	Mark                   string
+	Raw                    []byte
+}
+
+func (d formatData) PPU() string { return ppu(d.cpu) }
+
+func (d formatData) OperandVerbose() string { return d.in.OperandVerbose(d.cpu) }
+
+func (d formatData) AsmAnnotated() string {
+	return strings.TrimRight(d.in.Mnemonic.String()+" "+d.in.OperandAnnotated(d.cpu), " ")
+}
+
+func (d formatData) Fetch() string {
+	if d.in.CPU == nil {
+		return "-"
+	}
+	return d.in.fetches(d.cpu)
+}
+
+func (d formatData) Store() string {
+	if d.in.CPU == nil {
+		return ""
+	}
+	return d.in.stores(d.cpu)
+}
+
+// mark returns "*" for undocumented instructions
+func mark(in Instruction) string {
+	if in.IsUndocumented() {
+		return "*"
+	}
+	return ""
+}
+
+// ppu formats the PPU column, if the CPU has a PPU position
+func ppu(cpu CPU) string {
+	if cpu == nil {
+		return ""
+	}
+	scanline, dot, ok := cpu.PPUPosition()
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("PPU:%3d,%3d ", scanline, dot)
+}
+
 func fmtP(p uint8) (s string) {
 	var o = []rune("········")
 	for i, c := range []rune("NVUBDIZC") {
@@ -556,7 +866,12 @@ func padX(b []byte) (s string) {
 // Monitor for the CPU monitors instruction executions
 type Monitor interface {
 	// BeforeExecute gets called before instruction execution, returning false
-	// will stop execution and halt the CPU.
+	// will stop execution and halt the CPU. The monitor may Store to the CPU
+	// to patch memory, including the upcoming instruction, the CPU executes
+	// the patched bytes; the Instruction passed describes the bytes before
+	// patching. The Raw bytes of the Instruction are a buffer reused by the
+	// CPU, only valid during the call; Ring.Instructions and CPU.Trace return
+	// copies that can be retained.
 	BeforeExecute(CPU, Instruction) bool
 }
 
@@ -568,3 +883,18 @@ func (m InstructionPrinter) BeforeExecute(cpu CPU, in Instruction) bool {
 	m(in.Format(InstructionFormat, cpu))
 	return true
 }
+
+// tracer collects instructions, before passing them on to the next monitor
+type tracer struct {
+	next  Monitor
+	trace []Instruction
+}
+
+func (m *tracer) BeforeExecute(cpu CPU, in Instruction) bool {
+	in.Raw = append([]byte(nil), in.Raw...)
+	m.trace = append(m.trace, in)
+	if m.next != nil {
+		return m.next.BeforeExecute(cpu, in)
+	}
+	return true
+}
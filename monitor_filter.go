@@ -0,0 +1,26 @@
+package mos65xx
+
+// Filter is a Monitor that only forwards instructions with a PC in a range to
+// another Monitor, for tracing a single routine.
+type Filter struct {
+	// Monitor receives the instructions in range.
+	Monitor
+
+	// From and To are the first and last PC forwarded.
+	From, To uint16
+}
+
+// FilterMonitor creates a new Filter forwarding instructions with a PC from
+// up to and including to to inner.
+func FilterMonitor(inner Monitor, from, to uint16) *Filter {
+	return &Filter{Monitor: inner, From: from, To: to}
+}
+
+// BeforeExecute forwards the instruction if it is in range, returning the
+// result of the inner monitor, or true if it is out of range.
+func (f *Filter) BeforeExecute(cpu CPU, in Instruction) bool {
+	if pc := in.Registers.PC; pc < f.From || pc > f.To {
+		return true
+	}
+	return f.Monitor.BeforeExecute(cpu, in)
+}
@@ -0,0 +1,38 @@
+package mos65xx
+
+import "testing"
+
+func TestFilterMonitor(t *testing.T) {
+	var (
+		cpu, _ = newTestCPU(MOS6502, nil)
+		ring   = RingMonitor(8)
+		trace  = FilterMonitor(ring, 0x0602, 0x0604)
+	)
+	ring.Format = `{{printf "%04X" .PC}}`
+
+	cpu.Attach(trace)
+
+	for i := 0; i < 8; i++ {
+		cpu.Step()
+	}
+	if v := ring.Lines(); len(v) != 3 || v[0] != "0602" || v[2] != "0604" {
+		t.Fatalf("expected $0602-$0604, got %v", v)
+	}
+
+	// The inner monitor can only halt in range
+	trace.Monitor = haltMonitor{}
+	cpu.Registers().PC = 0x0600
+	cpu.Step()
+	cpu.Step()
+	if cpu.Halted() {
+		t.Fatal("expected not to halt outside the range")
+	}
+	cpu.Step()
+	if !cpu.Halted() {
+		t.Fatal("expected to halt in range")
+	}
+}
+
+type haltMonitor struct{}
+
+func (haltMonitor) BeforeExecute(CPU, Instruction) bool { return false }
@@ -0,0 +1,67 @@
+package mos65xx
+
+import "sort"
+
+// Profile is a Monitor that attributes the cycles spent to the address of
+// each executed instruction.
+//
+// Cycles are accounted using the cycle delta between consecutive
+// instructions, so the cycles of the most recently executed instruction are
+// only accounted once the next instruction is about to execute.
+type Profile struct {
+	// Cycles spent per instruction address.
+	Cycles map[uint16]int64
+
+	last    uint16
+	cycles  int64
+	started bool
+}
+
+// ProfileEntry is the number of cycles spent at an address.
+type ProfileEntry struct {
+	PC     uint16
+	Cycles int64
+}
+
+// ProfileMonitor creates a new Profile monitor.
+func ProfileMonitor() *Profile {
+	return &Profile{
+		Cycles: make(map[uint16]int64),
+	}
+}
+
+// BeforeExecute accounts the cycles spent since the previous instruction.
+func (p *Profile) BeforeExecute(cpu CPU, in Instruction) bool {
+	if p.started && in.Cycles >= p.cycles {
+		p.Cycles[p.last] += in.Cycles - p.cycles
+	}
+	p.last = in.Registers.PC
+	p.cycles = in.Cycles
+	p.started = true
+	return true
+}
+
+// Top returns at most n addresses with the most cycles spent, in descending
+// order.
+func (p *Profile) Top(n int) []ProfileEntry {
+	out := make([]ProfileEntry, 0, len(p.Cycles))
+	for pc, cycles := range p.Cycles {
+		out = append(out, ProfileEntry{PC: pc, Cycles: cycles})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Cycles == out[j].Cycles {
+			return out[i].PC < out[j].PC
+		}
+		return out[i].Cycles > out[j].Cycles
+	})
+	if n >= 0 && n < len(out) {
+		out = out[:n]
+	}
+	return out
+}
+
+// Reset discards the profile.
+func (p *Profile) Reset() {
+	p.Cycles = make(map[uint16]int64)
+	p.started = false
+}
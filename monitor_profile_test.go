@@ -0,0 +1,37 @@
+package mos65xx
+
+import "testing"
+
+func TestProfileMonitor(t *testing.T) {
+	var (
+		cpu, _ = newTestCPU(MOS6502, []byte{
+			0xa2, 0x03, // LDX #$03
+			0xca,       // DEX
+			0xd0, 0xfd, // BNE $0602
+		})
+		profile = ProfileMonitor()
+	)
+
+	cpu.Attach(profile)
+
+	// The NOP following the loop accounts the final BNE
+	for i := 0; i < 8; i++ {
+		cpu.Step()
+	}
+
+	top := profile.Top(2)
+	if len(top) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(top))
+	}
+	for i, want := range []ProfileEntry{
+		{0x0603, 8},
+		{0x0602, 6},
+	} {
+		if top[i] != want {
+			t.Errorf("entry %d: expected %+v, got %+v", i, want, top[i])
+		}
+	}
+	if v := len(profile.Top(-1)); v != 3 {
+		t.Errorf("expected 3 entries, got %d", v)
+	}
+}
@@ -0,0 +1,71 @@
+package mos65xx
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// Reference is a Monitor that compares the formatted instructions against the
+// lines of a reference trace log, halting the CPU at the first divergence.
+type Reference struct {
+	// Format is the instruction format, defaults to FormatNintendulator.
+	Format string
+
+	// Normalize is applied to each reference line before comparison, for
+	// dropping columns that are not rendered by Format; optional.
+	Normalize func(string) string
+
+	// Line is the line number of the last compared reference line.
+	Line int
+
+	// Want and Got are the reference and formatted line at the divergence.
+	Want, Got string
+
+	// Err is the error reading the reference, io.EOF if it was exhausted.
+	Err error
+
+	scanner *bufio.Scanner
+}
+
+// ReferenceMonitor creates a new Reference monitor reading the trace log
+// from r.
+func ReferenceMonitor(r io.Reader) *Reference {
+	return &Reference{
+		Format:  FormatNintendulator,
+		scanner: bufio.NewScanner(r),
+	}
+}
+
+// BeforeExecute compares the instruction with the next reference line,
+// returns false on divergence or if the reference can not be read.
+func (r *Reference) BeforeExecute(cpu CPU, in Instruction) bool {
+	if r.Diverged() || r.Err != nil {
+		return false
+	}
+	if !r.scanner.Scan() {
+		if r.Err = r.scanner.Err(); r.Err == nil {
+			r.Err = io.EOF
+		}
+		return false
+	}
+	r.Line++
+
+	want := r.scanner.Text()
+	if r.Normalize != nil {
+		want = r.Normalize(want)
+	}
+	want = strings.TrimRight(want, " ")
+
+	if got := strings.TrimRight(in.Format(r.Format, cpu), " "); got != want {
+		r.Want, r.Got = want, got
+		return false
+	}
+	return true
+}
+
+// Diverged returns true if a formatted instruction did not match the
+// reference.
+func (r *Reference) Diverged() bool {
+	return r.Want != r.Got
+}
@@ -0,0 +1,76 @@
+package mos65xx
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+func TestReferenceMonitor(t *testing.T) {
+	var (
+		cpu, _ = newTestCPU(MOS6502, nil)
+		ref    = ReferenceMonitor(strings.NewReader("0600 NOP\n0601 NOP\n0602 BRK\n"))
+	)
+	ref.Format = `{{printf "%04X %s" .PC .M}}`
+
+	cpu.Attach(ref)
+
+	for !cpu.Halted() {
+		cpu.Step()
+	}
+	if !ref.Diverged() {
+		t.Fatal("expected divergence")
+	}
+	if ref.Line != 3 || ref.Want != "0602 BRK" || ref.Got != "0602 NOP" {
+		t.Fatalf("expected divergence at line 3, got line %d: want %q, got %q", ref.Line, ref.Want, ref.Got)
+	}
+	if v := cpu.HaltReason(); v != HaltMonitor {
+		t.Fatalf("expected %s, got %s", HaltMonitor, v)
+	}
+}
+
+func TestNESTestReference(t *testing.T) {
+	bin, err := ioutil.ReadFile("testdata/nestest/nestest.bin")
+	if err != nil {
+		t.Skip(err)
+	}
+	log, err := os.Open("testdata/nestest/nestest.log")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer log.Close()
+
+	var (
+		mem = memory.New(0x10000)
+		cpu = New(Ricoh2A03, mem)
+		ref = ReferenceMonitor(log)
+	)
+	copy((*mem)[0x8000:], bin) // The 16K PRG ROM is mirrored at $8000
+	copy((*mem)[0xc000:], bin)
+	for i := 0x4000; i < 0x4018; i++ {
+		(*mem)[i] = 0xff // The APU registers read as open bus in the log
+	}
+
+	// Compare everything up to the PPU timing, the log names ISC "ISB"
+	ref.Format = `{{printf "%04X  %-8s %1s%-31s A:%02X X:%02X Y:%02X P:%02X SP:%02X" .PC .RawX .Mark .AsmAnnotated .A .X .Y .P .S}}`
+	ref.Normalize = func(line string) string {
+		return strings.Replace(line[:73], "*ISB ", "*ISC ", 1)
+	}
+	cpu.Registers().PC = 0xc000
+	cpu.Registers().P = U | I
+	cpu.Attach(ref)
+
+	for !cpu.Halted() {
+		cpu.Step()
+	}
+	if ref.Diverged() {
+		t.Fatalf("diverged at line %d:\nwant: %s\n got: %s", ref.Line, ref.Want, ref.Got)
+	}
+	if ref.Err != io.EOF {
+		t.Fatalf("expected the reference to be exhausted, got %v at line %d", ref.Err, ref.Line)
+	}
+}
@@ -0,0 +1,188 @@
+package mos65xx
+
+import "io"
+
+// Ring is a Monitor that keeps the most recent instructions in a circular
+// buffer, useful for post-mortem dumps of long running programs. Recording
+// an instruction does not allocate, instructions are only formatted by Lines
+// and Dump. The memory the instruction formats read (such as the operand
+// values and stores) and the PPU position are captured before execution.
+type Ring struct {
+	// Format is the instruction format, defaults to InstructionFormat.
+	Format string
+
+	slots []ringSlot
+	next  int
+	full  bool
+}
+
+// ringSlot holds an instruction, Raw points into raw
+type ringSlot struct {
+	in   Instruction
+	raw  [3]byte
+	mem  [4]ringByte // Memory read by the formats
+	nmem int
+	ppu  struct {
+		scanline, dot int
+		ok            bool
+	}
+}
+
+type ringByte struct {
+	addr  uint16
+	value uint8
+}
+
+// capture records the memory the formats read for the instruction
+func (slot *ringSlot) capture(cpu CPU) {
+	in := slot.in
+	slot.nmem = 0
+	add := func(addr uint16) {
+		slot.mem[slot.nmem] = ringByte{addr, cpu.Fetch(addr)}
+		slot.nmem++
+	}
+	switch in.AddressMode {
+	case Indirect:
+		if len(in.Raw) > 2 {
+			ptr := uint16(in.Raw[1]) | uint16(in.Raw[2])<<8
+			add(ptr)
+			add(ptr&0xff00 | uint16(uint8(ptr+1)))
+			add(ptr + 1) // Read by OperandAnnotated
+		}
+	case IndexedIndirect:
+		zp := in.Raw[1] + in.Registers.X
+		add(uint16(zp))
+		add(uint16(zp + 1))
+	case IndirectIndexed:
+		add(uint16(in.Raw[1]))
+		add(uint16(in.Raw[1] + 1))
+	}
+	switch in.Mnemonic {
+	case JMP, JSR:
+		switch in.AddressMode {
+		case IndexedIndirect, IndirectIndexed:
+			add(in.Addr())
+		}
+	case RTI, RTS, PLA, PLP:
+		add(in.stack(in.Registers.S + 1))
+		add(in.stack(in.Registers.S+1) + 1)
+		add(in.stack(in.Registers.S + 2))
+		add(in.stack(in.Registers.S+2) + 1)
+	default:
+		switch in.AddressMode {
+		case Accumulator, Implied, Immediate, Relative:
+		default:
+			add(in.Addr())
+		}
+	}
+	slot.ppu.scanline, slot.ppu.dot, slot.ppu.ok = cpu.PPUPosition()
+}
+
+// ringView is a CPU that reads the memory captured in a slot, other reads go
+// to the CPU
+type ringView struct {
+	CPU
+	slot ringSlot
+}
+
+func (v *ringView) Fetch(addr uint16) uint8 {
+	var (
+		in = v.slot.in
+		pc = in.Registers.PC
+	)
+	if off := addr - pc; off > 0 && int(off) < len(in.Raw) {
+		return in.Raw[off]
+	}
+	for _, b := range v.slot.mem[:v.slot.nmem] {
+		if b.addr == addr {
+			return b.value
+		}
+	}
+	return v.CPU.Fetch(addr)
+}
+
+func (v *ringView) PPUPosition() (scanline, dot int, ok bool) {
+	return v.slot.ppu.scanline, v.slot.ppu.dot, v.slot.ppu.ok
+}
+
+// RingMonitor creates a new Ring monitor that holds size instructions.
+func RingMonitor(size int) *Ring {
+	return &Ring{
+		Format: InstructionFormat,
+		slots:  make([]ringSlot, size),
+	}
+}
+
+// BeforeExecute copies the instruction into the next slot.
+func (r *Ring) BeforeExecute(cpu CPU, in Instruction) bool {
+	if len(r.slots) == 0 {
+		return true
+	}
+	slot := &r.slots[r.next]
+	in.CPU = cpu
+	in.Raw = slot.raw[:copy(slot.raw[:], in.Raw)]
+	slot.in = in
+	slot.capture(cpu)
+	if r.next++; r.next == len(r.slots) {
+		r.next = 0
+		r.full = true
+	}
+	return true
+}
+
+// Len is the number of instructions held.
+func (r *Ring) Len() int {
+	if r.full {
+		return len(r.slots)
+	}
+	return r.next
+}
+
+// Instructions returns the held instructions, oldest first. Their Raw bytes
+// are copies owned by the caller, their CPU reads the memory and PPU position
+// as captured before execution.
+func (r *Ring) Instructions() []Instruction {
+	out := make([]Instruction, 0, r.Len())
+	add := func(slots []ringSlot) {
+		for _, slot := range slots {
+			view := &ringView{CPU: slot.in.CPU, slot: slot}
+			view.slot.in.Raw = append([]byte(nil), slot.in.Raw...)
+			in := view.slot.in
+			in.CPU = view
+			out = append(out, in)
+		}
+	}
+	if r.full {
+		add(r.slots[r.next:])
+	}
+	add(r.slots[:r.next])
+	return out
+}
+
+// Lines returns the held instructions formatted, oldest first.
+func (r *Ring) Lines() []string {
+	var lines []string
+	for _, in := range r.Instructions() {
+		lines = append(lines, in.Format(r.Format, in.CPU))
+	}
+	return lines
+}
+
+// Dump writes the held instructions to w, oldest first.
+func (r *Ring) Dump(w io.Writer) error {
+	for _, line := range r.Lines() {
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset discards the held instructions.
+func (r *Ring) Reset() {
+	for i := range r.slots {
+		r.slots[i] = ringSlot{}
+	}
+	r.next = 0
+	r.full = false
+}
@@ -0,0 +1,83 @@
+package mos65xx
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRingMonitor(t *testing.T) {
+	var (
+		cpu, _ = newTestCPU(MOS6502, nil)
+		ring   = RingMonitor(4)
+	)
+	ring.Format = `{{printf "%04X %s" .PC .M}}`
+	cpu.Attach(ring)
+
+	for i := 0; i < 2; i++ {
+		cpu.Step()
+	}
+	if v := ring.Len(); v != 2 {
+		t.Fatalf("expected 2 instructions, got %d", v)
+	}
+
+	for i := 0; i < 8; i++ {
+		cpu.Step()
+	}
+	if v := ring.Len(); v != 4 {
+		t.Fatalf("expected 4 instructions, got %d", v)
+	}
+
+	var (
+		b    = new(bytes.Buffer)
+		want = "0606 NOP\n0607 NOP\n0608 NOP\n0609 NOP\n"
+	)
+	if err := ring.Dump(b); err != nil {
+		t.Fatal(err)
+	}
+	if v := b.String(); v != want {
+		t.Fatalf("expected dump:\n%s\ngot:\n%s", want, v)
+	}
+
+	if ins := ring.Instructions(); len(ins) != 4 || ins[0].Registers.PC != 0x0606 || ins[0].Raw[0] != 0xea {
+		t.Fatalf("expected 4 instructions from $0606, got %+v", ins)
+	}
+
+	// Recording does not allocate
+	if n := testing.AllocsPerRun(100, func() { cpu.Step() }); n != 0 {
+		t.Errorf("expected no allocations per step, got %.1f", n)
+	}
+
+	ring.Reset()
+	if v := ring.Len(); v != 0 {
+		t.Fatalf("expected 0 instructions after reset, got %d", v)
+	}
+}
+
+func TestRingMonitorCapture(t *testing.T) {
+	var (
+		cpu, mem = newTestCPU(MOS6502, []byte{
+			0xa5, 0x10, // LDA $10
+			0xa9, 0x99, // LDA #$99
+			0x85, 0x10, // STA $10
+		})
+		ring = RingMonitor(4)
+		dot  int
+	)
+	(*mem)[0x10] = 0x42
+	ring.Format = `{{.Fetch}} {{.PPU}}`
+
+	cpu.SetPPUPosition(func() (int, int) { return 0, dot })
+	cpu.Attach(ring)
+
+	for dot = 0; dot < 3; dot++ {
+		cpu.Step()
+	}
+
+	// The fetch and PPU columns are as they were before execution
+	lines := ring.Lines()
+	for i, want := range []string{"0010→42 PPU:  0,  0 ", "- PPU:  0,  1 "} {
+		if v := lines[i]; v != want {
+			t.Fatalf("expected %q, got %q", want, v)
+		}
+	}
+}
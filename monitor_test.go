@@ -0,0 +1,321 @@
+package mos65xx
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+func TestInstructionOperandVerbose(t *testing.T) {
+	var (
+		mem = memory.New(0x10000)
+		cpu = New(MOS6502, mem)
+	)
+	(*mem)[0xfb] = 0x34
+	(*mem)[0xfc] = 0x12
+	(*mem)[0xff] = 0x78
+	(*mem)[0x00] = 0x56
+	cpu.Registers().X = 0x04
+	cpu.Registers().Y = 0x0c
+
+	for _, test := range []struct {
+		Raw     []byte
+		Operand string
+		Verbose string
+	}{
+		{[]byte{0xb1, 0xfb}, "($FB),Y", "($FB),Y = $1234 @ $1240"},
+		{[]byte{0xa1, 0xf7}, "($F7,X)", "($F7,X) @ $FB = $1234"},
+		{[]byte{0xa1, 0xfb}, "($FB,X)", "($FB,X) @ $FF = $5678"}, // Wraps in the zero page
+		{[]byte{0xb5, 0xfe}, "$FE,X", "$FE,X @ $02"},
+		{[]byte{0xbd, 0xfe, 0x12}, "$12FE,X", "$12FE,X @ $1302"},
+		{[]byte{0xa9, 0x42}, "#$42", "#$42"},
+	} {
+		copy((*mem)[0x0600:], test.Raw)
+		in := Disassemble(mem, 0x0600)
+		in.Registers = *cpu.Registers()
+		if v := in.Operand(); v != test.Operand {
+			t.Errorf("% X: expected operand %q, got %q", test.Raw, test.Operand, v)
+		}
+		if v := in.OperandVerbose(cpu); v != test.Verbose {
+			t.Errorf("% X: expected verbose operand %q, got %q", test.Raw, test.Verbose, v)
+		}
+	}
+}
+
+type cycleMonitor []int
+
+func (m *cycleMonitor) BeforeExecute(cpu CPU, in Instruction) bool {
+	*m = append(*m, in.InstructionCycles(cpu))
+	return true
+}
+
+func TestInstructionCycles(t *testing.T) {
+	var (
+		mem = memory.New(0x10000).Reset(0xea) // NOP
+		cpu = New(MOS6502, mem)
+		mon = new(cycleMonitor)
+	)
+	(*mem)[0x10] = 0xff
+	(*mem)[0x11] = 0x12
+	copy((*mem)[0x06e0:], []byte{
+		0xa2, 0x01, // LDX #$01
+		0xa0, 0x01, // LDY #$01
+		0xbd, 0x00, 0x12, // LDA $1200,X
+		0xbd, 0xff, 0x12, // LDA $12FF,X (page cross)
+		0xb1, 0x10, // LDA ($10),Y (page cross)
+		0x9d, 0xff, 0x12, // STA $12FF,X (no penalty)
+		0xd0, 0x00, // BNE *+2 (taken)
+		0xf0, 0x00, // BEQ *+2 (not taken)
+		0xd0, 0x10, // BNE *+18 (taken, page cross)
+	})
+	cpu.Registers().PC = 0x06e0
+	cpu.Attach(mon)
+
+	var got []int
+	for i := 0; i < 10; i++ {
+		got = append(got, cpu.Step())
+	}
+	for i, want := range []int{2, 2, 4, 5, 6, 5, 3, 2, 4, 2} {
+		if (*mon)[i] != want {
+			t.Errorf("instruction %d: expected %d cycles, got %d", i, want, (*mon)[i])
+		}
+		if got[i] != (*mon)[i] {
+			t.Errorf("instruction %d: expected %d cycles from Step, got %d", i, (*mon)[i], got[i])
+		}
+	}
+}
+
+func TestInstructionDecoded(t *testing.T) {
+	cpu, mem := newTestCPU(MOS6502, []byte{
+		0xbd, 0x00, 0x12, // LDA $1200,X
+	})
+
+	for _, in := range []Instruction{
+		Disassemble(mem, 0x0600),
+		cpu.Trace(1)[0],
+	} {
+		if in.Size != 3 || in.BaseCycles != 4 || in.PageCrossCycles != 1 {
+			t.Fatalf("expected size 3, 4 cycles and 1 page cross cycle, got %d, %d and %d",
+				in.Size, in.BaseCycles, in.PageCrossCycles)
+		}
+	}
+}
+
+func TestInstructionOperandBranch(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	copy((*mem)[0x0600:], []byte{
+		0xd0, 0x10, // BNE $0612
+		0xf0, 0xfc, // BEQ $0600
+	})
+
+	for _, test := range []struct {
+		Addr    uint16
+		Operand string
+		Offset  string
+	}{
+		{0x0600, "$0612", "$10"},
+		{0x0602, "$0600", "$FC"}, // Backward
+	} {
+		in := Disassemble(mem, test.Addr)
+		if v := in.Operand(); v != test.Operand {
+			t.Errorf("%04X: expected operand %q, got %q", test.Addr, test.Operand, v)
+		}
+		BranchOffsets = true
+		if v := in.Operand(); v != test.Offset {
+			t.Errorf("%04X: expected offset operand %q, got %q", test.Addr, test.Offset, v)
+		}
+		BranchOffsets = false
+	}
+}
+
+func TestInstructionString(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	copy((*mem)[0x0600:], []byte{
+		0xa9, 0x42, // LDA #$42
+	})
+
+	for _, test := range []struct {
+		Instruction
+		Want string
+	}{
+		{Disassemble(mem, 0x0600), "0600 LDA #$42"},
+		{Disassemble(mem, 0x0602), "0602 NOP"},
+	} {
+		if v := test.Instruction.String(); v != test.Want {
+			t.Errorf("expected %q, got %q", test.Want, v)
+		}
+		if v := fmt.Sprintf("%v", test.Instruction); v != test.Want {
+			t.Errorf("expected %%v to be %q, got %q", test.Want, v)
+		}
+	}
+}
+
+// countingMemory counts the reads
+type countingMemory struct {
+	*memory.RAM
+	reads int
+}
+
+func (mem *countingMemory) Fetch(addr uint16) uint8 {
+	mem.reads++
+	return mem.RAM.Fetch(addr)
+}
+
+func TestFormatLazy(t *testing.T) {
+	mem := &countingMemory{RAM: memory.New(0x10000)}
+	copy((*mem.RAM)[0x0600:], []byte{0xb1, 0x10}) // LDA ($10),Y
+	in := Disassemble(mem, 0x0600)
+
+	// Without a CPU, only the columns that need it are unavailable
+	if v, want := in.Format("{{.Asm}}", nil), "LDA ($10),Y"; v != want {
+		t.Errorf("expected %q, got %q", want, v)
+	}
+	if v, want := in.Format("{{.OperandVerbose}}", nil), "($10),Y"; v != want {
+		t.Errorf("expected %q, got %q", want, v)
+	}
+
+	// Columns that read memory are only evaluated if used
+	cpu := New(MOS6502, mem)
+	mem.reads = 0
+	in.Format("{{.Asm}}", cpu)
+	if mem.reads != 0 {
+		t.Errorf("expected no memory reads, got %d", mem.reads)
+	}
+	in.Format("{{.OperandVerbose}}", cpu)
+	if mem.reads == 0 {
+		t.Error("expected OperandVerbose to read memory")
+	}
+}
+
+func TestFormatNintendulator(t *testing.T) {
+	mem := memory.New(0x10000)
+	copy((*mem)[0xc000:], []byte{0x4c, 0xf5, 0xc5}) // JMP $C5F5
+	(*mem)[0xc6e4] = 0x1a                           // NOP (implied)
+	cpu := New(Ricoh2A03, mem)
+	cpu.Registers().PC = 0xc000
+	cpu.Registers().P = 0x24
+
+	// The first line of nestest.log
+	in := cpu.NextInstruction()
+	in.Cycles = 7
+	want := "C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD CYC:7"
+	if v := in.Format(FormatNintendulator, cpu); v != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, v)
+	}
+
+	cpu.SetPPUPosition(func() (int, int) { return 0, 21 })
+	want = "C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7"
+	if v := in.Format(FormatNintendulator, cpu); v != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, v)
+	}
+
+	cpu.Registers().PC = 0xc6e4
+	in = cpu.NextInstruction()
+	want = "C6E4  1A       *NOP                             A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:0"
+	if v := in.Format(FormatNintendulator, cpu); v != want {
+		t.Errorf("expected:\n%s\ngot:\n%s", want, v)
+	}
+
+	// The PPU position belongs to the CPU
+	other := New(Ricoh2A03, mem)
+	other.Registers().PC = 0xc000
+	if v := other.NextInstruction().Format(FormatNintendulator, other); strings.Contains(v, "PPU:") {
+		t.Errorf("expected no PPU column for another CPU, got %q", v)
+	}
+}
+
+func TestInstructionIsUndocumented(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	copy((*mem)[0x0600:], []byte{
+		0xa7, 0x10, // LAX $10
+		0xeb, 0x01, // SBC #$01 (duplicate)
+		0x1a,       // NOP (implied)
+		0xe9, 0x01, // SBC #$01
+	})
+
+	for _, test := range []struct {
+		Addr         uint16
+		Undocumented bool
+	}{
+		{0x0600, true},
+		{0x0602, true},
+		{0x0604, true},
+		{0x0605, false},
+		{0x0607, false},
+	} {
+		in := Disassemble(mem, test.Addr)
+		if v := in.IsUndocumented(); v != test.Undocumented {
+			t.Errorf("%s: expected %t, got %t", in, test.Undocumented, v)
+		}
+	}
+}
+
+func TestInstructionMarshalJSON(t *testing.T) {
+	mem := memory.New(0x10000).Reset(0xea) // NOP
+	copy((*mem)[0x0600:], []byte{
+		0xa9, 0x42, // LDA #$42
+	})
+	cpu := New(MOS6502, mem)
+	cpu.Registers().PC = 0x0600
+	cpu.Registers().A = 0x01
+
+	b, err := json.Marshal(cpu.Trace(1)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"Cycles":0,"Mnemonic":"LDA","Registers":{"PC":1536,"S":253,"P":52,"A":1,"X":0,"Y":0},"AddressMode":"immediate","Raw":"A942"}`
+	if v := string(b); v != want {
+		t.Fatalf("expected %s, got %s", want, v)
+	}
+}
+
+// patchMonitor stores a value before the instruction at PC executes
+type patchMonitor struct {
+	PC, Addr uint16
+	Value    uint8
+}
+
+func (m patchMonitor) BeforeExecute(cpu CPU, in Instruction) bool {
+	if in.Registers.PC == m.PC {
+		cpu.Store(m.Addr, m.Value)
+	}
+	return true
+}
+
+func TestMonitorPatch(t *testing.T) {
+	for _, test := range []struct {
+		patchMonitor
+		Want uint8
+	}{
+		{patchMonitor{0x0600, 0x0601, 0x42}, 0x42}, // LDA #$2A → LDA #$42
+		{patchMonitor{0x0600, 0x0600, 0xa2}, 0x00}, // LDA #$2A → LDX #$2A
+		{patchMonitor{0x0602, 0x0010, 0x99}, 0x99}, // LDA $10 after patching $10
+		{patchMonitor{0x0602, 0x0603, 0x20}, 0x77}, // LDA $10 → LDA $20
+	} {
+		for _, cached := range []bool{false, true} {
+			mem := memory.New(0x10000).Reset(0xea) // NOP
+			copy((*mem)[0x0600:], []byte{
+				0xa9, 0x2a, // LDA #$2A
+				0xa5, 0x10, // LDA $10
+			})
+			(*mem)[0x0020] = 0x77
+			cpu := New(MOS6502, mem)
+			if cached {
+				// Decode the instruction into the cache before patching
+				cpu.CacheDecoding(0x0600, 0x06ff)
+				cpu.Registers().PC = test.PC
+				cpu.Step()
+				cpu.Registers().A = 0x00
+			}
+			cpu.Registers().PC = test.PC
+			cpu.Attach(test.patchMonitor)
+			cpu.Step()
+			if v := cpu.Registers().A; v != test.Want {
+				t.Errorf("patching $%04X with $%02X (cached %t): expected A=$%02X, got $%02X", test.Addr, test.Value, cached, test.Want, v)
+			}
+		}
+	}
+}
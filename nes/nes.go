@@ -0,0 +1,105 @@
+// Package nes loads NES cartridge images in the iNES and NES 2.0 formats.
+package nes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+// Sizes of the header, the trainer and the ROM banks
+const (
+	HeaderSize  = 16
+	TrainerSize = 512
+	PRGBankSize = 0x4000
+	CHRBankSize = 0x2000
+)
+
+var magic = []byte("NES\x1a")
+
+// Cart is a cartridge image
+type Cart struct {
+	// Mapper is the mapper number
+	Mapper int
+
+	// NES2 is true if the header is in the NES 2.0 format
+	NES2 bool
+
+	// Vertical is true for vertical nametable mirroring, false for horizontal
+	Vertical bool
+
+	// Battery is true if the cartridge has battery backed PRG-RAM
+	Battery bool
+
+	// Trainer is the optional 512 byte trainer
+	Trainer []byte
+
+	// PRG and CHR are the program and character ROM
+	PRG, CHR memory.ROM
+}
+
+// Load a cartridge image from all data read from r.
+func Load(r io.Reader) (*Cart, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < HeaderSize || !bytes.Equal(b[:4], magic) {
+		return nil, errors.New("nes: not an iNES image")
+	}
+
+	var (
+		header  = b[:HeaderSize]
+		prgSize = int(header[4])
+		chrSize = int(header[5])
+		cart    = &Cart{
+			Mapper:   int(header[6]>>4) | int(header[7]&0xf0),
+			NES2:     header[7]&0x0c == 0x08,
+			Vertical: header[6]&0x01 == 0x01,
+			Battery:  header[6]&0x02 == 0x02,
+		}
+	)
+	if cart.NES2 {
+		if header[9]&0x0f == 0x0f || header[9]&0xf0 == 0xf0 {
+			return nil, errors.New("nes: exponent ROM sizes are not supported")
+		}
+		cart.Mapper |= int(header[8]&0x0f) << 8
+		prgSize |= int(header[9]&0x0f) << 8
+		chrSize |= int(header[9]&0xf0) << 4
+	}
+	prgSize *= PRGBankSize
+	chrSize *= CHRBankSize
+
+	b = b[HeaderSize:]
+	if header[6]&0x04 == 0x04 {
+		if len(b) < TrainerSize {
+			return nil, errors.New("nes: truncated trainer")
+		}
+		cart.Trainer, b = b[:TrainerSize], b[TrainerSize:]
+	}
+	if len(b) < prgSize+chrSize {
+		return nil, fmt.Errorf("nes: expected %d bytes of PRG and CHR ROM, got %d", prgSize+chrSize, len(b))
+	}
+	cart.PRG = memory.ROM(b[:prgSize])
+	cart.CHR = memory.ROM(b[prgSize : prgSize+chrSize])
+	return cart, nil
+}
+
+// Map the PRG-ROM into m at $8000-$FFFF. Only mapper 0 (NROM) is supported, a
+// 16kB PRG-ROM is mirrored at $C000.
+func (cart *Cart) Map(m *memory.Mapper) error {
+	if cart.Mapper != 0 {
+		return fmt.Errorf("nes: mapper %d is not supported", cart.Mapper)
+	}
+	switch len(cart.PRG) {
+	case PRGBankSize, 2 * PRGBankSize:
+	default:
+		return fmt.Errorf("nes: NROM expects 16kB or 32kB PRG-ROM, got %d bytes", len(cart.PRG))
+	}
+	m.Map(0x8000, 0xffff, memory.Masked{Memory: cart.PRG, Mask: uint16(len(cart.PRG) - 1)})
+	return nil
+}
@@ -0,0 +1,84 @@
+package nes
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tehmaze/mos65xx/memory"
+)
+
+func TestLoad(t *testing.T) {
+	f, err := os.Open("../testdata/instr_test-v4/rom_singles/01-basics.nes")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer f.Close()
+	bin, err := ioutil.ReadFile("../testdata/instr_test-v4/rom_singles/01-basics.bin")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	cart, err := Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart.Mapper != 0 || len(cart.PRG) != 0x8000 || len(cart.CHR) != 0x2000 {
+		t.Fatalf("expected mapper 0 with 32kB PRG and 8kB CHR, got mapper %d with %d and %d bytes",
+			cart.Mapper, len(cart.PRG), len(cart.CHR))
+	}
+
+	m := memory.NewMapper()
+	if err = cart.Map(m); err != nil {
+		t.Fatal(err)
+	}
+	for addr := 0x8000; addr <= 0xffff; addr++ {
+		if v := m.Fetch(uint16(addr)); v != bin[addr-0x8000] {
+			t.Fatalf("expected $%02X at $%04X, got $%02X", bin[addr-0x8000], addr, v)
+		}
+	}
+}
+
+func TestLoadMirror(t *testing.T) {
+	image := append([]byte("NES\x1a\x01\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00"), make([]byte, PRGBankSize)...)
+	image[HeaderSize+0x3ffc] = 0x42
+
+	cart, err := Load(bytes.NewReader(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cart.Vertical {
+		t.Error("expected vertical mirroring")
+	}
+
+	m := memory.NewMapper()
+	if err = cart.Map(m); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []uint16{0xbffc, 0xfffc} {
+		if v := m.Fetch(addr); v != 0x42 {
+			t.Errorf("expected $42 at $%04X, got $%02X", addr, v)
+		}
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	for _, test := range []struct {
+		Name  string
+		Image []byte
+	}{
+		{"empty", nil},
+		{"magic", []byte("NES\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")},
+		{"truncated", []byte("NES\x1a\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")},
+	} {
+		if _, err := Load(bytes.NewReader(test.Image)); err == nil {
+			t.Errorf("%s: expected error", test.Name)
+		}
+	}
+
+	cart := &Cart{Mapper: 1, PRG: make(memory.ROM, PRGBankSize)}
+	if err := cart.Map(memory.NewMapper()); err == nil {
+		t.Error("expected error mapping MMC1")
+	}
+}
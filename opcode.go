@@ -98,6 +98,68 @@ func (m Mnemonic) String() string {
 	return mnemonicName[m]
 }
 
+// IsLegal returns true if the mnemonic is part of the documented instruction
+// set. NOP and SBC are legal, even though some of their opcodes are not, see
+// Instruction.IsUndocumented.
+func (m Mnemonic) IsLegal() bool {
+	return m < HLT
+}
+
+// writesMemory returns true for instructions that store to their operand
+func writesMemory(m Mnemonic) bool {
+	switch m {
+	case STA, STX, STY, SAX, AHX, TAS, SHX, SHY,
+		ASL, LSR, ROL, ROR, INC, DEC,
+		SLO, SRE, RLA, RRA, DCP, ISC:
+		return true
+	}
+	return false
+}
+
+// Class classifies opcodes by how well their behaviour is defined
+type Class uint8
+
+// Opcode classes
+const (
+	Legal           Class = iota // Documented instruction
+	IllegalStable                // Undocumented, but consistent across chips
+	IllegalUnstable              // Undocumented, depends on the chip and bus state
+	Jam                          // Halts the CPU (KIL)
+)
+
+var className = map[Class]string{
+	Legal:           "legal",
+	IllegalStable:   "illegal stable",
+	IllegalUnstable: "illegal unstable",
+	Jam:             "jam",
+}
+
+func (c Class) String() string {
+	if s, ok := className[c]; ok {
+		return s
+	}
+	return "invalid"
+}
+
+// OpcodeClass returns the class of the opcode
+func OpcodeClass(code uint8) Class {
+	switch op := opcodes[code]; {
+	case documented(code):
+		return Legal
+	case op.Mnemonic == HLT:
+		return Jam
+	case op.Mnemonic == LAX && op.Mode == Immediate:
+		// Also known as LXA, the result depends on an unstable magic constant
+		return IllegalUnstable
+	default:
+		switch op.Mnemonic {
+		case XAA, AHX, TAS, SHX, SHY, LAS:
+			return IllegalUnstable
+		}
+		return IllegalStable
+	}
+}
+
 // opcode is a CPU operation code
 type opcode struct {
 	Mnemonic
@@ -107,6 +169,47 @@ type opcode struct {
 	Mode            AddressMode
 }
 
+// OpCycleInfo describes the size and timing of an opcode
+type OpCycleInfo struct {
+	Code      uint8
+	Mnemonic  Mnemonic
+	Mode      AddressMode
+	Size      int // Instruction size in bytes
+	Cycles    int // Base cycles
+	PageCross int // Extra cycles if indexing crosses a page boundary
+}
+
+// CycleTable returns the size and timing of all 256 opcodes, indexed by the
+// opcode. Relative branches are listed with their base cycles, they take one
+// more cycle if taken and another if the target is on a different page.
+func CycleTable() []OpCycleInfo {
+	table := make([]OpCycleInfo, len(opcodes))
+	for code, op := range opcodes {
+		table[code] = OpCycleInfo{
+			Code:      uint8(code),
+			Mnemonic:  op.Mnemonic,
+			Mode:      op.Mode,
+			Size:      op.Size,
+			Cycles:    op.Cycles,
+			PageCross: op.PageCrossCycles,
+		}
+	}
+	return table
+}
+
+// documented returns true if the opcode is part of the documented instruction
+// set; the undocumented opcodes include the NOP variants and the SBC duplicate.
+func documented(code uint8) bool {
+	switch op := opcodes[code]; op.Mnemonic {
+	case NOP:
+		return code == 0xea
+	case SBC:
+		return code != 0xeb
+	default:
+		return op.Mnemonic < HLT
+	}
+}
+
 // opcodes
 var opcodes = [0x100]opcode{
 	{BRK, 1, 7, 0, Implied},         // 0x00
@@ -349,7 +452,7 @@ var opcodes = [0x100]opcode{
 	{SBC, 3, 4, 0, Absolute},        // 0xed
 	{INC, 3, 6, 0, Absolute},        // 0xee
 	{ISC, 3, 6, 0, Absolute},        // 0xef
-	{BEQ, 2, 2, 1, Relative},        // 0xf0
+	{BEQ, 2, 2, 0, Relative},        // 0xf0
 	{SBC, 2, 5, 1, IndirectIndexed}, // 0xf1
 	{HLT, 1, 0, 0, Implied},         // 0xf2
 	{ISC, 2, 8, 0, IndirectIndexed}, // 0xf3
@@ -0,0 +1,80 @@
+package mos65xx
+
+import "testing"
+
+func TestOpcodeClass(t *testing.T) {
+	for _, test := range []struct {
+		Code uint8
+		Want Class
+	}{
+		{0xa9, Legal},           // LDA #
+		{0xea, Legal},           // NOP
+		{0x1a, IllegalStable},   // NOP
+		{0xa7, IllegalStable},   // LAX $nn
+		{0xeb, IllegalStable},   // SBC #
+		{0xab, IllegalUnstable}, // LAX #
+		{0x8b, IllegalUnstable}, // XAA #
+		{0x9c, IllegalUnstable}, // SHY $nnnn,X
+		{0x02, Jam},             // KIL
+	} {
+		if v := OpcodeClass(test.Code); v != test.Want {
+			t.Errorf("$%02X: expected %s, got %s", test.Code, test.Want, v)
+		}
+	}
+
+	count := make(map[Class]int)
+	for code := 0; code < 0x100; code++ {
+		count[OpcodeClass(uint8(code))]++
+	}
+	for class, want := range map[Class]int{
+		Legal:           151,
+		IllegalStable:   85,
+		IllegalUnstable: 8,
+		Jam:             12,
+	} {
+		if v := count[class]; v != want {
+			t.Errorf("expected %d %s opcodes, got %d", want, class, v)
+		}
+	}
+}
+
+func TestMnemonicIsLegal(t *testing.T) {
+	for _, test := range []struct {
+		Mnemonic
+		Legal bool
+	}{
+		{LDA, true},
+		{NOP, true},
+		{SBC, true},
+		{TYA, true},
+		{HLT, false},
+		{LAX, false},
+		{AXS, false},
+	} {
+		if v := test.IsLegal(); v != test.Legal {
+			t.Errorf("%s: expected %t, got %t", test.Mnemonic, test.Legal, v)
+		}
+	}
+}
+
+func TestCycleTable(t *testing.T) {
+	table := CycleTable()
+	if len(table) != 256 {
+		t.Fatalf("expected 256 entries, got %d", len(table))
+	}
+	for code, info := range table {
+		if info.Code != uint8(code) {
+			t.Errorf("$%02X: entry has code $%02X", code, info.Code)
+		}
+	}
+	for _, want := range []OpCycleInfo{
+		{0xa9, LDA, Immediate, 2, 2, 0},
+		{0xbd, LDA, AbsoluteX, 3, 4, 1},
+		{0x9d, STA, AbsoluteX, 3, 5, 0},
+		{0xd0, BNE, Relative, 2, 2, 0},
+	} {
+		if v := table[want.Code]; v != want {
+			t.Errorf("$%02X: expected %+v, got %+v", want.Code, want, v)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+; Test extra cycle added for page crossing in LDA (zp),Y
+;
+; Result: A = AA, X = 55, cycles = 39 (second load crossed page)
+; Patch $0618 to $0F for no page cross: A = 55, X = 55, cycles = 38
+
+LDA #$55
+STA $02FF
+LDA #$AA
+STA $0300
+
+; pointer at $10 to $02F0
+LDA #$F0
+STA $10
+LDA #$02
+STA $11
+
+; $02F0 + $0F = $02FF, 5 cycles
+LDY #$0F
+LDA ($10),Y
+TAX
+
+; $02F0 + $10 = $0300, page cross, 6 cycles
+LDY #$10
+LDA ($10),Y